@@ -0,0 +1,138 @@
+package gotalk
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrAccessDenied is the error sent to requestors which may not call an operation.
+// See Handlers.SetOpAccess.
+var ErrAccessDenied = errors.New("access denied")
+
+// OpAccess describes who may call an operation. See Handlers.SetOpAccess.
+type OpAccess struct {
+	Roles  []string // the principal must have at least one of these roles (none = any role)
+	Scopes []string // the principal must have all of these scopes
+}
+
+// AccessPolicy decides whether the principal of socket `s` (see Sock.Principal) may call
+// operation `op`. `access` is the OpAccess of the operation, or nil if it has none.
+// Returning a non-nil error denies the request. The error is logged with AccessDeniedLogger
+// while the requestor receives ErrAccessDenied.
+type AccessPolicy func(s *Sock, op string, access *OpAccess) error
+
+// DefaultAccessPolicy allows operations which have no OpAccess to be called by anyone, and
+// operations which have one by sockets with a principal which has the required roles and scopes.
+func DefaultAccessPolicy(s *Sock, op string, access *OpAccess) error {
+	if access == nil {
+		return nil
+	}
+	p := s.Principal()
+	if p == nil {
+		return errors.New("not authenticated")
+	}
+	if len(access.Roles) != 0 && !containsAny(p.Roles, access.Roles) {
+		return fmt.Errorf("principal %q has none of the roles %q", p.ID, access.Roles)
+	}
+	for _, scope := range access.Scopes {
+		if !containsAny(p.Scopes, []string{scope}) {
+			return fmt.Errorf("principal %q lacks scope %q", p.ID, scope)
+		}
+	}
+	return nil
+}
+
+// SetOpAccess sets who may call operation `op`, replacing any OpAccess set earlier.
+// Passing nil removes it. If `op` is the empty string, `access` applies to all operations which
+// don't have their own OpAccess. Requests are checked with the AccessPolicy (see
+// SetAccessPolicy) before their handler is called. Notifications are checked the same way,
+// using their name as `op`, and are dropped when denied.
+func (h *Handlers) SetOpAccess(op string, access *OpAccess) {
+	h.accessMu.Lock()
+	defer h.accessMu.Unlock()
+	if len(op) == 0 {
+		h.fallbackAccess = access
+	} else if access == nil {
+		delete(h.access, op)
+	} else {
+		if h.access == nil {
+			h.access = make(map[string]*OpAccess)
+		}
+		h.access[op] = access
+	}
+}
+
+// HandleWithAccess is like Handle but also sets who may call the operation, as with SetOpAccess.
+func (h *Handlers) HandleWithAccess(op string, access *OpAccess, fn interface{}) {
+	h.SetOpAccess(op, access)
+	h.Handle(op, fn)
+}
+
+// SetAccessPolicy sets the policy which decides whether requests may be made.
+// If nil, the policy of outer handlers (see NewSubHandlers) or DefaultAccessPolicy is used.
+func (h *Handlers) SetAccessPolicy(policy AccessPolicy) {
+	h.accessMu.Lock()
+	defer h.accessMu.Unlock()
+	h.accessPolicy = policy
+}
+
+// findOpAccess returns the OpAccess of operation `op`, or nil if it has none.
+// An OpAccess set for `op` by any handlers along the outer chain takes precedence over fallbacks,
+// and the fallback of inner handlers takes precedence over the fallback of outer handlers.
+func (h *Handlers) findOpAccess(op string) *OpAccess {
+	for h2 := h; h2 != nil; h2 = h2.outer {
+		if access := h2.ownOpAccess(op); access != nil {
+			return access
+		}
+	}
+	for h2 := h; h2 != nil; h2 = h2.outer {
+		if access := h2.ownOpAccess(""); access != nil {
+			return access
+		}
+	}
+	return nil
+}
+
+// ownOpAccess returns the OpAccess set for `op` on h itself, or its fallback if `op` is empty
+func (h *Handlers) ownOpAccess(op string) *OpAccess {
+	h.accessMu.RLock()
+	defer h.accessMu.RUnlock()
+	if len(op) == 0 {
+		return h.fallbackAccess
+	}
+	return h.access[op]
+}
+
+func (h *Handlers) findAccessPolicy() AccessPolicy {
+	h.accessMu.RLock()
+	defer h.accessMu.RUnlock()
+	if h.accessPolicy != nil {
+		return h.accessPolicy
+	}
+	if h.outer != nil {
+		return h.outer.findAccessPolicy()
+	}
+	return DefaultAccessPolicy
+}
+
+// authorize checks whether the socket may call operation `op`. Denials are logged with
+// AccessDeniedLogger.
+func (s *Sock) authorize(op string) bool {
+	err := s.Handlers.findAccessPolicy()(s, op, s.Handlers.findOpAccess(op))
+	if err != nil {
+		AccessDeniedLogger(s, "access denied: %v (op %q)", err, op)
+		return false
+	}
+	return true
+}
+
+func containsAny(list, values []string) bool {
+	for _, a := range list {
+		for _, b := range values {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package gotalk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestOpAccess(t *testing.T) {
+	h := &Handlers{}
+	echo := func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	}
+	h.HandleBufferRequest("ping", echo)
+	h.HandleBufferRequest("read", echo)
+	h.HandleBufferRequest("delete", echo)
+	h.HandleStreamRequest("export", func(s *Sock, op string, rch chan []byte, out io.WriteCloser) error {
+		for range rch {
+		}
+		return out.Close()
+	})
+	h.SetOpAccess("read", &OpAccess{Roles: []string{"reader", "admin"}})
+	h.SetOpAccess("delete", &OpAccess{Roles: []string{"admin"}, Scopes: []string{"files:write"}})
+	h.SetOpAccess("export", &OpAccess{Roles: []string{"admin"}})
+	h.HandleWithAccess("whoami", &OpAccess{Roles: []string{"reader"}}, func(s *Sock) (string, error) {
+		return s.Principal().ID, nil
+	})
+	notes := make(chan string, 4)
+	h.HandleBufferNotification("", func(s *Sock, name string, b []byte) {
+		notes <- name
+	})
+	h.SetOpAccess("alert", &OpAccess{Roles: []string{"admin"}})
+
+	var denials []string
+	defer func(l LoggerFunc) { AccessDeniedLogger = l }(AccessDeniedLogger)
+	AccessDeniedLogger = func(s *Sock, format string, args ...interface{}) {
+		denials = append(denials, fmt.Sprintf(format, args...))
+	}
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	call := func(op string) string {
+		t.Helper()
+		if _, err := s1.BufferRequest(op, []byte("x")); err != nil {
+			return err.Error()
+		}
+		return "ok"
+	}
+
+	// no principal
+	assertEq(t, "ok", call("ping"))
+	assertEq(t, "access denied", call("read"))
+	assertEq(t, 1, len(denials))
+	assertEq(t, `access denied: not authenticated (op "read")`, denials[0])
+	assertEq(t, "access denied", call("whoami"))
+
+	// notifications are dropped when denied
+	go func() {
+		s1.Notify("alert", nil)
+		s1.Notify("news", nil)
+	}()
+	assertEq(t, "news", <-notes)
+	assertEq(t, `access denied: not authenticated (op "alert")`, denials[len(denials)-1])
+
+	s2.SetPrincipal(&Principal{ID: "robin", Roles: []string{"reader"}})
+	assertEq(t, "ok", call("read"))
+	assertEq(t, "ok", call("whoami"))
+	assertEq(t, "access denied", call("delete"))
+
+	s2.SetPrincipal(&Principal{ID: "robin", Roles: []string{"admin"}})
+	assertEq(t, "access denied", call("delete")) // lacks scope
+	assertEq(t, `access denied: principal "robin" lacks scope "files:write" (op "delete")`,
+		denials[len(denials)-1])
+
+	s2.SetPrincipal(&Principal{ID: "robin", Roles: []string{"admin"}, Scopes: []string{"files:write"}})
+	assertEq(t, "ok", call("read"))
+	assertEq(t, "ok", call("delete"))
+	go s1.Notify("alert", nil)
+	assertEq(t, "alert", <-notes)
+
+	// stream requests
+	s2.SetPrincipal(&Principal{ID: "sam", Roles: []string{"reader"}})
+	r, reschan := s1.StreamRequest("export")
+	if err := r.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	res := <-reschan
+	assertEq(t, true, res.IsError())
+	assertEq(t, "access denied", res.Error())
+}
+
+func TestAccessPolicy(t *testing.T) {
+	h := &Handlers{}
+	h.HandleBufferRequest("ping", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+	h.SetOpAccess("", &OpAccess{Roles: []string{"member"}}) // applies to all ops
+	sub := h.NewSubHandlers()
+
+	defer func(l LoggerFunc) { AccessDeniedLogger = l }(AccessDeniedLogger)
+	AccessDeniedLogger = func(s *Sock, format string, args ...interface{}) {}
+
+	s1, s2, err := Pipe(sub, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	_, err = s1.BufferRequest("ping", nil)
+	assertEq(t, "access denied", err.Error())
+
+	// policy of outer handlers applies to sub handlers
+	var seen *OpAccess
+	h.SetAccessPolicy(func(s *Sock, op string, access *OpAccess) error {
+		seen = access
+		if op == "ping" {
+			return nil
+		}
+		return errors.New("no")
+	})
+	if _, err := s1.BufferRequest("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "member", seen.Roles[0])
+
+	// op's own OpAccess takes precedence over the fallback
+	sub.SetOpAccess("ping", &OpAccess{Scopes: []string{"ping"}})
+	if _, err := s1.BufferRequest("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "ping", seen.Scopes[0])
+
+	// fallback of the sub handlers takes precedence over the fallback of outer handlers,
+	// but not over an OpAccess set for the op on outer handlers
+	sub.SetOpAccess("ping", nil)
+	sub.SetOpAccess("", &OpAccess{Roles: []string{"guest"}})
+	if _, err := s1.BufferRequest("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "guest", seen.Roles[0])
+	h.SetOpAccess("ping", &OpAccess{Roles: []string{"admin"}})
+	if _, err := s1.BufferRequest("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "admin", seen.Roles[0])
+}
@@ -0,0 +1,181 @@
+package gotalk
+
+import (
+	"sync"
+	"time"
+)
+
+// AdaptiveLimiter limits the number of concurrent buffer requests to a limit which adapts to
+// the latency of request handlers, using additive increase and multiplicative decrease (AIMD.)
+// While handlers are fast and the limit is being used, the limit grows by about one for every
+// "limit" number of requests. When a handler is slow, the limit is reduced by Backoff.
+//
+// A handler is slow if it takes longer than TargetLatency or, if TargetLatency is 0, longer
+// than Tolerance times the lowest latency observed. The lowest latency slowly drifts towards
+// the average so that the limiter adapts to lasting changes.
+//
+// Set Limits.Adaptive to use an AdaptiveLimiter. All sockets using the same Limits share the
+// limiter. Requests which exceed the limit receive a retry response with a wait time based on
+// how soon a request is expected to finish, bounded by Limits.BufferMinWait and BufferMaxWait.
+// The zero value is ready to use with the defaults described below.
+type AdaptiveLimiter struct {
+	MinLimit      uint32        // lower bound of the limit (default 1)
+	MaxLimit      uint32        // upper bound of the limit (default 1000)
+	InitialLimit  uint32        // limit to start with (default 10)
+	TargetLatency time.Duration // latency above which the limit is decreased (0=relative)
+	Tolerance     float64       // see above (default 2)
+	Backoff       float64       // factor the limit is multiplied by when decreased (default 0.9)
+
+	mu          sync.Mutex
+	initialized bool
+	min, max    float64 // MinLimit and MaxLimit with defaults applied
+	tolerance   float64
+	backoff     float64
+	limit       float64
+	inflight    uint32
+	avgLatency  float64   // moving average, in seconds
+	minLatency  float64   // in seconds
+	lastBackoff time.Time // time of the last decrease
+}
+
+// Weights of new samples in the average latency and of the average in the lowest latency
+const (
+	adaptiveAvgWeight = 0.1
+	adaptiveMinWeight = 0.001
+)
+
+// init applies defaults on first use. l.mu must be locked.
+func (l *AdaptiveLimiter) init() {
+	if l.initialized {
+		return
+	}
+	l.initialized = true
+	l.min, l.max = 1, 1000
+	if l.MinLimit != 0 {
+		l.min = float64(l.MinLimit)
+	}
+	if l.MaxLimit != 0 {
+		l.max = float64(l.MaxLimit)
+	}
+	if l.max < l.min {
+		l.max = l.min
+	}
+	l.tolerance, l.backoff = 2, 0.9
+	if l.Tolerance > 1 {
+		l.tolerance = l.Tolerance
+	}
+	if l.Backoff > 0 && l.Backoff < 1 {
+		l.backoff = l.Backoff
+	}
+	l.limit = 10
+	if l.InitialLimit != 0 {
+		l.limit = float64(l.InitialLimit)
+	}
+	l.limit = l.clamp(l.limit)
+}
+
+func (l *AdaptiveLimiter) clamp(limit float64) float64 {
+	if limit < l.min {
+		return l.min
+	}
+	if limit > l.max {
+		return l.max
+	}
+	return limit
+}
+
+// Limit returns the current limit
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return int(l.limit)
+}
+
+// InFlight returns the number of requests currently being handled
+func (l *AdaptiveLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.inflight)
+}
+
+func (l *AdaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	if float64(l.inflight) >= l.limit {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+func (l *AdaptiveLimiter) release() {
+	l.mu.Lock()
+	l.inflight--
+	l.mu.Unlock()
+}
+
+// observe adjusts the limit to the latency of a request which just finished
+func (l *AdaptiveLimiter) observe(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	now := time.Now()
+	sec := latency.Seconds()
+	if l.avgLatency == 0 {
+		l.avgLatency, l.minLatency = sec, sec
+	} else {
+		l.avgLatency += (sec - l.avgLatency) * adaptiveAvgWeight
+		if sec < l.minLatency {
+			l.minLatency = sec
+		} else {
+			l.minLatency += (l.avgLatency - l.minLatency) * adaptiveMinWeight
+		}
+	}
+
+	var slow bool
+	if l.TargetLatency > 0 {
+		slow = latency > l.TargetLatency
+	} else {
+		slow = sec > l.minLatency*l.tolerance
+	}
+
+	if slow {
+		// decrease at most once per average latency, since requests which were started before
+		// the previous decrease are likely to be slow as well
+		if now.Sub(l.lastBackoff).Seconds() >= l.avgLatency {
+			l.limit = l.clamp(l.limit * l.backoff)
+			l.lastBackoff = now
+		}
+	} else if float64(l.inflight+1) >= l.limit/2 {
+		// only grow while the limit is being used
+		l.limit = l.clamp(l.limit + 1/l.limit)
+	}
+}
+
+// waitHint returns how long, in milliseconds, a requestor should wait before retrying:
+// the expected time until a request finishes, given the number of requests in flight and
+// their average latency, bounded by min and max.
+func (l *AdaptiveLimiter) waitHint(min, max uint32) uint32 {
+	l.mu.Lock()
+	avg, inflight, limit := l.avgLatency, l.inflight, l.limit
+	l.mu.Unlock()
+	if avg == 0 || inflight == 0 {
+		return min
+	}
+	// requests finish at a rate of about inflight/avg per second and requests beyond the limit
+	// need to wait for one to finish
+	excess := float64(inflight) - limit + 1
+	if excess < 1 {
+		excess = 1
+	}
+	ms := excess * avg / float64(inflight) * 1000
+	if ms < float64(min) {
+		return min
+	}
+	if ms > float64(max) {
+		return max
+	}
+	return uint32(ms)
+}
@@ -0,0 +1,84 @@
+package gotalk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	l := &AdaptiveLimiter{InitialLimit: 4, MaxLimit: 8}
+	assertEq(t, l.Limit(), 4)
+
+	// acquire respects the limit
+	for i := 0; i < 4; i++ {
+		assertEq(t, l.acquire(), true)
+	}
+	assertEq(t, l.acquire(), false)
+	assertEq(t, l.InFlight(), 4)
+
+	// fast handlers grow the limit while it is being used, up to MaxLimit
+	for i := 0; i < 200; i++ {
+		l.observe(time.Millisecond)
+	}
+	assertEq(t, l.Limit(), 8)
+	assertEq(t, l.acquire(), true)
+
+	// a slow handler shrinks the limit
+	l.observe(100 * time.Millisecond)
+	assertEq(t, l.Limit() < 8, true)
+
+	// at most once per average latency
+	limit := l.Limit()
+	l.observe(100 * time.Millisecond)
+	assertEq(t, l.Limit(), limit)
+
+	for i := 0; i < 5; i++ {
+		l.release()
+	}
+	assertEq(t, l.InFlight(), 0)
+
+	// TargetLatency
+	l = &AdaptiveLimiter{InitialLimit: 10, TargetLatency: 10 * time.Millisecond, Backoff: 0.5}
+	l.observe(5 * time.Millisecond)
+	l.observe(20 * time.Millisecond)
+	assertEq(t, l.Limit(), 5)
+
+	// MinLimit
+	l = &AdaptiveLimiter{InitialLimit: 2, MinLimit: 2, TargetLatency: time.Millisecond}
+	l.observe(time.Second)
+	assertEq(t, l.Limit(), 2)
+}
+
+func TestAdaptiveLimiterWaitHint(t *testing.T) {
+	l := &AdaptiveLimiter{InitialLimit: 2}
+	// nothing known yet
+	assertEq(t, l.waitHint(10, 1000), uint32(10))
+
+	assertEq(t, l.acquire(), true)
+	assertEq(t, l.acquire(), true)
+	l.observe(200 * time.Millisecond)
+	// two requests in flight taking 200ms each: one finishes in about 100ms
+	assertEq(t, l.waitHint(10, 1000), uint32(100))
+	// bounded by min and max
+	assertEq(t, l.waitHint(150, 1000), uint32(150))
+	assertEq(t, l.waitHint(10, 50), uint32(50))
+}
+
+func TestAdaptiveLimits(t *testing.T) {
+	adaptive := &AdaptiveLimiter{InitialLimit: 1, MaxLimit: 1}
+	limits := &Limits{
+		BufferRequests: Unlimited,
+		BufferMinWait:  10 * time.Millisecond,
+		BufferMaxWait:  500 * time.Millisecond,
+		Adaptive:       adaptive,
+	}
+	l := makeLimitsImpl(limits)
+	assertEq(t, l.incBufferReq(), true)
+	assertEq(t, l.incBufferReq(), false)
+	l.observeBufferReq(100 * time.Millisecond)
+	assertEq(t, l.waitBufferReq(), uint32(100))
+	l.decBufferReq()
+	assertEq(t, adaptive.InFlight(), 0)
+	assertEq(t, l.incBufferReq(), true)
+	l.decBufferReq()
+}
@@ -0,0 +1,142 @@
+package gotalk
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// Authentication.
+//
+// A server with an Authenticator (see Server.Authenticator and WebSocketServer.Authenticator)
+// authenticates each socket right after the handshake, before any of its messages are handled
+// and before AcceptHandler or OnConnect is called. The Authenticator is given the credentials
+// of the other end: a token sent by the client (see Sock.AuthToken), the TLS connection state
+// for mutual TLS and, for web sockets, the HTTP request with its cookies and headers. If it
+// accepts the credentials, the Principal it returns is attached to the socket (see
+// Sock.Principal.) Otherwise the connection is closed with ProtocolErrorUnauthorized, which
+// the client sees as ErrUnauthorized.
+//
+// A client sends its token right after its capabilities announcement, as a notification with
+// the name authNoteName, and includes "auth" in the announcement so that the server knows to
+// expect it. Since servers read the announcement to find out, clients which don't announce
+// capabilities (protocol version 1) can't connect to servers which use authentication.
+
+const authNoteName = "gotalk/auth"
+
+// Longest time a server waits for the announcement and token of a client
+const authTimeout = 10 * time.Second
+
+// Principal identifies the authenticated party at the other end of a socket
+type Principal struct {
+	ID     string      // e.g. a user name
+	Roles  []string    // roles of the principal (see OpAccess)
+	Scopes []string    // scopes the principal has been granted (see OpAccess)
+	Data   interface{} // anything the application wants to keep with the principal
+}
+
+// Credentials are the means by which the other end of a socket can be authenticated.
+// See Authenticator.
+type Credentials struct {
+	Token   string               // sent by the client (see Sock.AuthToken); empty if none
+	TLS     *tls.ConnectionState // nil unless the connection uses TLS
+	Request *http.Request        // for web sockets, the HTTP request which opened the connection
+}
+
+// Authenticator checks the credentials of a newly connected socket. It returns the principal
+// to attach to the socket, or an error to reject the connection.
+type Authenticator func(s *Sock, c *Credentials) (*Principal, error)
+
+// Principal returns the principal attached to the socket, or nil if there is none
+func (s *Sock) Principal() *Principal {
+	p, _ := s.principal.Load().(*Principal)
+	return p
+}
+
+// SetPrincipal attaches p to the socket. Sockets authenticated by a server's Authenticator
+// have the principal it returned attached.
+func (s *Sock) SetPrincipal(p *Principal) {
+	s.principal.Store(p)
+}
+
+// sendAuthToken sends s.AuthToken to the server
+func (s *Sock) sendAuthToken() error {
+	return s.writeMsg(MsgTypeNotification, "", authNoteName, 0, []byte(s.AuthToken))
+}
+
+// authenticate authenticates a socket which has just completed the handshake, using a to
+// check the credentials c and the token sent by the client, if any. If a rejects them, or the
+// client fails to announce its capabilities, the connection is closed.
+func (s *Sock) authenticate(a Authenticator, c *Credentials) error {
+	token, err := s.readAuthToken()
+	if err != nil {
+		code := int32(ProtocolErrorInvalidMsg)
+		if err == ErrUnsupported {
+			code = ProtocolErrorUnsupported
+		} else if err == ErrTimeout {
+			code = ProtocolErrorTimeout
+		}
+		s.closeError(code)
+		return err
+	}
+	c.Token = token
+	p, err := a(s, c)
+	if err != nil || p == nil {
+		if err != nil {
+			ErrorLogger(s, "authentication failed: %v", err)
+		}
+		s.closeError(ProtocolErrorUnauthorized)
+		return ErrUnauthorized
+	}
+	s.SetPrincipal(p)
+	return nil
+}
+
+// readAuthToken reads the capabilities announcement of the client and its token, if it
+// announces that it sends one. Returns ErrUnsupported if the client doesn't announce its
+// capabilities and ErrTimeout if it takes longer than authTimeout.
+func (s *Sock) readAuthToken() (string, error) {
+	if rd, ok := s.conn.(readDeadline); ok {
+		if err := rd.SetReadDeadline(time.Now().Add(authTimeout)); err == nil {
+			defer rd.SetReadDeadline(time.Time{})
+		}
+	}
+	readbuf := make([]byte, 128)
+
+	t, _, name, _, size, err := ReadMsg(s.conn, readbuf)
+	if err != nil {
+		return "", authReadError(err)
+	}
+	if !isAnnouncement(t, name, size) {
+		return "", ErrUnsupported
+	}
+	buf := make([]byte, size)
+	if _, err := readn(s.conn, buf); err != nil {
+		return "", authReadError(err)
+	}
+	a := parseAnnouncement(string(buf))
+	s.setPeerCaps(s.announcement(0, 0).agree(a))
+	if !a.auth {
+		return "", nil
+	}
+
+	t, _, name, _, size, err = ReadMsg(s.conn, readbuf)
+	if err != nil {
+		return "", authReadError(err)
+	}
+	if t != MsgTypeNotification || name != authNoteName || size > maxAnnouncementSize {
+		return "", ErrInvalidMsg
+	}
+	buf = make([]byte, size)
+	if _, err := readn(s.conn, buf); err != nil {
+		return "", authReadError(err)
+	}
+	return string(buf), nil
+}
+
+func authReadError(err error) error {
+	if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
+		return ErrTimeout
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+package gotalk
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func tokenAuthenticator(s *Sock, c *Credentials) (*Principal, error) {
+	if c.Token != "secret" {
+		return nil, errors.New("invalid token")
+	}
+	return &Principal{ID: "robin"}, nil
+}
+
+func whoamiHandlers() *Handlers {
+	h := &Handlers{}
+	h.HandleBufferRequest("whoami", func(s *Sock, op string, b []byte) ([]byte, error) {
+		if p := s.Principal(); p != nil {
+			return []byte(p.ID), nil
+		}
+		return nil, nil
+	})
+	return h
+}
+
+// startAuthTestServer starts a server which authenticates sockets with a and serves "whoami"
+func startAuthTestServer(t *testing.T, a Authenticator) *Server {
+	t.Helper()
+	server, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handlers = whoamiHandlers()
+	server.Authenticator = a
+	go server.Accept()
+	return server
+}
+
+func TestAuthenticator(t *testing.T) {
+	server := startAuthTestServer(t, tokenAuthenticator)
+	defer server.Close()
+
+	// accepted
+	s := NewSock(DefaultHandlers)
+	s.AuthToken = "secret"
+	if err := s.Connect("tcp", server.Addr(), DefaultLimits); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	b, err := s.BufferRequest("whoami", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "robin", string(b))
+
+	// rejected
+	for _, token := range []string{"wrong", ""} {
+		s := NewSock(DefaultHandlers)
+		s.AuthToken = token
+		if err := s.Connect("tcp", server.Addr(), DefaultLimits); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "connection to be closed", s.IsClosed)
+		assertEq(t, ErrUnauthorized, s.checkCloseCode())
+		_, err := s.BufferRequest("whoami", nil)
+		assertEq(t, ErrUnauthorized, err)
+	}
+}
+
+func TestAuthenticatorKeepAlive(t *testing.T) {
+	server := startAuthTestServer(t, tokenAuthenticator)
+	defer server.Close()
+
+	// a rejected socket doesn't try to reconnect
+	type change struct {
+		state ConnState
+		err   error
+	}
+	changes := make(chan change, 16)
+	s := NewSock(DefaultHandlers)
+	s.AuthToken = "wrong"
+	err := s.ConnectKeepAlive(&KeepAlive{
+		Dial: func() (io.ReadWriteCloser, error) {
+			return net.Dial("tcp", server.Addr())
+		},
+		MinDelay: time.Millisecond,
+		OnStateChange: func(s *Sock, state ConnState, err error) {
+			changes <- change{state, err}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assertEq(t, ConnStateConnecting, (<-changes).state)
+	assertEq(t, ConnStateConnected, (<-changes).state)
+	c := <-changes
+	assertEq(t, ConnStateClosed, c.state)
+	assertEq(t, ErrUnauthorized, c.err)
+	select {
+	case c := <-changes:
+		t.Fatalf("unexpected state change to %v", c.state)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAuthenticatorV1Client(t *testing.T) {
+	server := startAuthTestServer(t, func(s *Sock, c *Credentials) (*Principal, error) {
+		return &Principal{ID: "anyone"}, nil
+	})
+	defer server.Close()
+
+	// a client which doesn't announce its capabilities is rejected
+	c, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := WriteVersion(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadVersion(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(MakeMsg(MsgTypeSingleReq, "0001", "whoami", 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	readbuf := make([]byte, 128)
+	for {
+		t1, _, _, _, size, err := ReadMsg(c, readbuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if t1 == MsgTypeProtocolError {
+			assertEq(t, uint32(ProtocolErrorUnsupported), size)
+			break
+		}
+		readn(c, make([]byte, size)) // the server's announcement
+	}
+}
+
+func TestWebSocketAuthenticator(t *testing.T) {
+	wss := NewWebSocketServer()
+	wss.Handlers = whoamiHandlers()
+	wss.Authenticator = func(s *Sock, c *Credentials) (*Principal, error) {
+		cookie, err := c.Request.Cookie("session")
+		if err != nil || cookie.Value != "abc" {
+			return nil, errors.New("no session")
+		}
+		return &Principal{ID: "sam"}, nil
+	}
+	hs := httptest.NewServer(wss)
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	connect := func(cookie string) *Sock {
+		config, err := websocket.NewConfig(url, hs.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Header.Set("Cookie", cookie)
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewSock(&Handlers{})
+		if err := s.ConnectReader(ws, DefaultLimits); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := connect("session=abc")
+	defer s.Close()
+	b, err := s.BufferRequest("whoami", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "sam", string(b))
+
+	s2 := connect("session=xyz")
+	defer s2.Close()
+	waitFor(t, "connection to be closed", s2.IsClosed)
+	assertEq(t, ErrUnauthorized, s2.checkCloseCode())
+}
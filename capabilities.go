@@ -0,0 +1,268 @@
+package gotalk
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Protocol features which are not part of protocol version 1 are only used when the other end
+// has announced that it supports them. The announcement is sent by Handshake, right after the
+// protocol version, as a notification with the name capabilitiesNoteName and a payload which
+// lists the supported features separated by spaces. Features which have parameters are listed
+// as name=value, e.g. "maxpayload=1048576". Peers which don't know about capabilities treat
+// the announcement as an unhandled notification and ignore it, and since they never announce
+// anything themselves, no extended features are used with them. Unknown features are ignored,
+// which is how new features are added without breaking older peers.
+//
+// The other end's capabilities become known when its announcement has been read, which is
+// always the first message from peers which announce capabilities. Messages sent before then,
+// which is only possible right after the handshake, don't use any features. In particular,
+// their headers are not sent. Nothing waits for the announcement, since peers which don't
+// announce capabilities may never send anything.
+
+const capabilitiesNoteName = "gotalk/capabilities"
+
+// Largest accepted announcement, regardless of Limits.MaxPayloadSize
+const maxAnnouncementSize = 4096
+
+// isAnnouncement returns true if a message is an announcement of a reasonable size
+func isAnnouncement(t MsgType, name string, size uint32) bool {
+	return t == MsgTypeNotification && name == capabilitiesNoteName && size <= maxAnnouncementSize
+}
+
+// capability is a protocol feature
+type capability uint32
+
+const (
+	capDeadline = capability(1 << iota) // MsgTypeReqDeadline
+	capHeader                           // MsgTypeHeader
+	capCancel                           // MsgTypeCancelReq
+	capFlow                             // MsgTypeStreamReqWindow and MsgTypeStreamResWindow
+
+	capAll = capDeadline | capHeader | capCancel | capFlow
+)
+
+var capabilityNames = []struct {
+	c    capability
+	name string
+}{
+	{capCancel, "cancel"},
+	{capDeadline, "deadline"},
+	{capFlow, "flow"},
+	{capHeader, "header"},
+}
+
+// Names of features with parameters
+const (
+	capCodecName      = "codec"      // codecs which can be decoded, e.g. "codec=json,gob"
+	capMaxPayloadName = "maxpayload" // largest payload accepted (see Limits.MaxPayloadSize)
+	capAuthName       = "auth"       // an authentication token follows the announcement
+	capWindowName     = "window"     // flow control window of incoming streams (see Flow control)
+)
+
+func (c capability) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c&n.c != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func parseCapabilities(s string) capability {
+	return parseAnnouncement(s).caps
+}
+
+// Capabilities describes the protocol features which both ends of a connection support.
+// See Sock.Capabilities.
+type Capabilities struct {
+	// Features supported by both ends, e.g. "cancel", "deadline", "flow" or "header"
+	Features []string
+
+	// Codecs which both ends can decode, in order of preference of this end (see Codec)
+	Codecs []string
+
+	// MaxPayloadSize is the largest payload the other end accepts (0=no limit or unknown.)
+	// Requests and notifications with larger payloads fail with ErrPayloadTooLarge.
+	MaxPayloadSize uint32
+
+	// StreamWindow is the flow control window which the other end uses for streams it receives
+	// (0=no flow control or unknown.) See Limits.StreamWindow.
+	StreamWindow uint32
+}
+
+// Has returns true if both ends support feature
+func (c Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// announcement is the content of a capabilities announcement
+type announcement struct {
+	caps           capability
+	codecs         []string
+	maxPayloadSize uint32 // 0 means no limit or unknown
+	streamWindow   uint32 // 0 means no flow control of incoming streams
+	auth           bool   // an authentication token follows (see auth.go)
+}
+
+func (a announcement) String() string {
+	var b strings.Builder
+	b.WriteString(a.caps.String())
+	if len(a.codecs) != 0 {
+		b.WriteString(" " + capCodecName + "=" + strings.Join(a.codecs, ","))
+	}
+	if a.maxPayloadSize != 0 {
+		b.WriteString(" " + capMaxPayloadName + "=" + strconv.FormatUint(uint64(a.maxPayloadSize), 10))
+	}
+	if a.streamWindow != 0 {
+		b.WriteString(" " + capWindowName + "=" + strconv.FormatUint(uint64(a.streamWindow), 10))
+	}
+	if a.auth {
+		b.WriteString(" " + capAuthName)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func parseAnnouncement(s string) announcement {
+	var a announcement
+	for _, field := range strings.Fields(s) {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case capCodecName:
+			a.codecs = strings.Split(value, ",")
+		case capMaxPayloadName:
+			if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+				a.maxPayloadSize = uint32(n)
+			}
+		case capWindowName:
+			if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+				a.streamWindow = uint32(n)
+			}
+		case capAuthName:
+			a.auth = true
+		default:
+			for _, n := range capabilityNames {
+				if n.name == name {
+					a.caps |= n.c
+				}
+			}
+			// ignore unknown features
+		}
+	}
+	return a
+}
+
+// announcement returns what we support. maxPayloadSize is the limit of payloads we accept and
+// streamWindow the flow control window of streams we receive.
+func (s *Sock) announcement(maxPayloadSize, streamWindow uint32) announcement {
+	codecs := []string{s.codec().Name()}
+	for _, c := range knownCodecs {
+		if c.Name() != codecs[0] {
+			codecs = append(codecs, c.Name())
+		}
+	}
+	return announcement{
+		caps:           capAll,
+		codecs:         codecs,
+		maxPayloadSize: maxPayloadSize,
+		streamWindow:   streamWindow,
+		auth:           s.AuthToken != "",
+	}
+}
+
+// agree returns the capabilities which both we (a) and the other end (peer) support
+func (a announcement) agree(peer announcement) announcement {
+	agreed := announcement{caps: a.caps & peer.caps, maxPayloadSize: peer.maxPayloadSize}
+	if agreed.caps&capFlow != 0 {
+		agreed.streamWindow = peer.streamWindow
+	}
+	for _, c := range a.codecs {
+		for _, c2 := range peer.codecs {
+			if c == c2 {
+				agreed.codecs = append(agreed.codecs, c)
+				break
+			}
+		}
+	}
+	return agreed
+}
+
+// sendCapabilities tells the other end what we support
+func (s *Sock) sendCapabilities(maxPayloadSize, streamWindow uint32) error {
+	payload := []byte(s.announcement(maxPayloadSize, streamWindow).String())
+	return s.writeMsg(MsgTypeNotification, "", capabilitiesNoteName, 0, payload)
+}
+
+// readCapabilities is called when the other end's announcement is received. Returns
+// ErrInvalidMsg if it is larger than maxAnnouncementSize.
+func (s *Sock) readCapabilities(size int) error {
+	if size > maxAnnouncementSize {
+		return ErrInvalidMsg
+	}
+	buf := make([]byte, size)
+	if _, err := readn(s.conn, buf); err != nil {
+		return err
+	}
+	s.setPeerCaps(s.announcement(0, 0).agree(parseAnnouncement(string(buf))))
+	return nil
+}
+
+// setPeerCaps records the capabilities which both ends support, unless they are already known.
+// Must only be called by the goroutine reading the connection or before reading starts.
+func (s *Sock) setPeerCaps(a announcement) {
+	s.peerCapsMu.Lock()
+	defer s.peerCapsMu.Unlock()
+	if s.peerCapsAreKnown() {
+		return
+	}
+	s.peerCodecs = a.codecs
+	atomic.StoreUint32(&s.peerMaxPayload, a.maxPayloadSize)
+	atomic.StoreUint32(&s.peerStreamWindow, a.streamWindow)
+	atomic.StoreUint32(&s.peerCaps, uint32(a.caps))
+	atomic.StoreUint32(&s.peerCapsKnown, 1)
+}
+
+// peerCapsAreKnown returns true once the capabilities of the other end are known
+func (s *Sock) peerCapsAreKnown() bool {
+	return atomic.LoadUint32(&s.peerCapsKnown) != 0
+}
+
+// peerSupports returns true if the other end has announced support for c
+func (s *Sock) peerSupports(c capability) bool {
+	return capability(atomic.LoadUint32(&s.peerCaps))&c == c
+}
+
+// peerAccepts returns false if the other end has announced that it doesn't accept payloads of
+// size bytes
+func (s *Sock) peerAccepts(size int) bool {
+	max := atomic.LoadUint32(&s.peerMaxPayload)
+	return max == 0 || uint64(size) <= uint64(max)
+}
+
+// Capabilities returns the protocol features which both ends of the connection support.
+// Until the other end's announcement has been read, which happens right after the handshake,
+// and with peers which don't announce any capabilities (like older versions of gotalk), no
+// features are returned.
+func (s *Sock) Capabilities() Capabilities {
+	caps := capability(atomic.LoadUint32(&s.peerCaps))
+	c := Capabilities{
+		MaxPayloadSize: atomic.LoadUint32(&s.peerMaxPayload),
+		StreamWindow:   atomic.LoadUint32(&s.peerStreamWindow),
+	}
+	for _, n := range capabilityNames {
+		if caps&n.c != 0 {
+			c.Features = append(c.Features, n.name)
+		}
+	}
+	s.peerCapsMu.Lock()
+	c.Codecs = append([]string(nil), s.peerCodecs...)
+	s.peerCapsMu.Unlock()
+	return c
+}
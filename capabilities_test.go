@@ -0,0 +1,178 @@
+package gotalk
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	assertEq(t, "cancel deadline flow header", capAll.String())
+	assertEq(t, capDeadline, parseCapabilities("foo deadline bar"))
+	assertEq(t, capability(0), parseCapabilities(""))
+
+	a := parseAnnouncement("header flow x=1 codec=gob,json maxpayload=1024 maxpayload window=64")
+	assertEq(t, capHeader|capFlow, a.caps)
+	assertEq(t, "gob,json", joinStrings(a.codecs))
+	assertEq(t, uint32(1024), a.maxPayloadSize)
+	assertEq(t, uint32(64), a.streamWindow)
+	assertEq(t, "flow header codec=gob,json maxpayload=1024 window=64", a.String())
+
+	ours := announcement{caps: capAll, codecs: []string{"json", "gob"}, maxPayloadSize: 10}
+	agreed := ours.agree(a)
+	assertEq(t, capHeader|capFlow, agreed.caps)
+	assertEq(t, uint32(64), agreed.streamWindow)
+	assertEq(t, "json,gob", joinStrings(agreed.codecs))
+	assertEq(t, uint32(1024), agreed.maxPayloadSize)
+
+	// the codec doesn't depend on what the other end prefers
+	s0 := NewSock(&Handlers{})
+	s0.setPeerCaps(agreed)
+	assertEq(t, JSONCodec, s0.codec())
+
+	// the handshake exchanges capabilities
+	server, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Limits = &Limits{BufferRequests: Unlimited, MaxPayloadSize: 32}
+	server.Handlers = &Handlers{Codec: GobCodec}
+	server.Handlers.Handle("add", func(args [2]int) (int, error) { return args[0] + args[1], nil })
+	accepted := make(chan *Sock, 1)
+	server.AcceptHandler = func(s *Sock) { accepted <- s }
+	go server.Accept()
+
+	s := NewSock(DefaultHandlers)
+	s.Codec = GobCodec
+	if err := s.Connect("tcp", server.Addr(), DefaultLimits); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// values are encoded with the codec set on both ends, also right after connecting
+	var sum int
+	if err := s.Request("add", [2]int{1, 2}, &sum); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 3, sum)
+
+	s2 := <-accepted
+	waitFor(t, "capabilities", func() bool {
+		return s.peerSupports(capAll) && s2.peerSupports(capAll)
+	})
+
+	c := s.Capabilities()
+	assertEq(t, "cancel,deadline,flow,header", joinStrings(c.Features))
+	assertEq(t, "gob,json", joinStrings(c.Codecs))
+	assertEq(t, uint32(32), c.MaxPayloadSize)
+	assertEq(t, true, c.Has("header"))
+	assertEq(t, false, c.Has("compress"))
+
+	c = s2.Capabilities()
+	assertEq(t, "gob,json", joinStrings(c.Codecs))
+	assertEq(t, DefaultLimits.MaxPayloadSize, c.MaxPayloadSize)
+
+	// payloads which the other end doesn't accept are not sent
+	_, err = s.BufferRequest("echo", make([]byte, 33))
+	assertEq(t, ErrPayloadTooLarge, err)
+	assertEq(t, ErrPayloadTooLarge, s.BufferNotify("note", make([]byte, 33)))
+}
+
+func TestCapabilitiesV1Peer(t *testing.T) {
+	// a peer which only speaks protocol version 1 doesn't announce any capabilities
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	done := make(chan error, 1)
+	go func() {
+		if _, err := ReadVersion(c2); err != nil {
+			done <- err
+			return
+		}
+		if _, err := WriteVersion(c2); err != nil {
+			done <- err
+			return
+		}
+		// read and ignore our announcement
+		readbuf := make([]byte, 128)
+		_, _, name, _, size, err := ReadMsg(c2, readbuf)
+		if err == nil {
+			assertEq(t, capabilitiesNoteName, name)
+			_, err = readn(c2, make([]byte, size))
+		}
+		if err == nil {
+			_, err = c2.Write(MakeMsg(MsgTypeNotification, "", "hello", 0, 0))
+		}
+		done <- err
+	}()
+
+	s := NewSock(&Handlers{})
+	if err := s.ConnectReader(c1, DefaultLimits); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "capabilities to become known", s.peerCapsAreKnown)
+	c := s.Capabilities()
+	assertEq(t, 0, len(c.Features))
+	assertEq(t, 0, len(c.Codecs))
+	assertEq(t, uint32(0), c.MaxPayloadSize)
+	assertEq(t, false, s.peerSupports(capCancel))
+}
+
+func TestCapabilitiesOversized(t *testing.T) {
+	// an announcement which is too large closes the connection instead of being read, even
+	// without a payload size limit, and is never passed on to notification handlers
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	done := make(chan error, 1)
+	go func() {
+		if _, err := ReadVersion(c2); err != nil {
+			done <- err
+			return
+		}
+		if _, err := WriteVersion(c2); err != nil {
+			done <- err
+			return
+		}
+		readbuf := make([]byte, 128)
+		_, _, _, _, size, err := ReadMsg(c2, readbuf)
+		if err == nil {
+			_, err = readn(c2, make([]byte, size))
+		}
+		if err == nil {
+			_, err = c2.Write(MakeMsg(MsgTypeNotification, "", capabilitiesNoteName, 0,
+				maxAnnouncementSize+1))
+		}
+		if err == nil {
+			var mt MsgType
+			mt, _, _, _, size, err = ReadMsg(c2, readbuf)
+			assertEq(t, MsgTypeProtocolError, mt)
+			assertEq(t, uint32(ProtocolErrorInvalidMsg), size)
+		}
+		done <- err
+	}()
+
+	var notes int32
+	h := &Handlers{}
+	h.HandleBufferNotification("", func(s *Sock, name string, b []byte) {
+		atomic.AddInt32(&notes, 1)
+	})
+	s := NewSock(h)
+	if err := s.ConnectReader(c1, NoLimits); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "socket to close", s.IsClosed)
+	assertEq(t, int32(0), atomic.LoadInt32(&notes))
+}
+
+func joinStrings(v []string) string {
+	return strings.Join(v, ",")
+}
@@ -0,0 +1,77 @@
+package gotalk
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec encodes and decodes the values of requests, results and notifications sent with
+// Sock.Request and Sock.Notify and received by handlers registered with Handlers.Handle and
+// Handlers.HandleNotification. Buffer requests and notifications are not affected.
+//
+// The codec used by a socket is the first non-nil of Sock.Codec and Handlers.Codec, or
+// JSONCodec if neither is set. The codec is never chosen based on what the other end announces,
+// so both peers must be set up to use the same codec. Sock.Capabilities lists the codecs which
+// both ends can decode. Note that the JavaScript library only supports JSON.
+type Codec interface {
+	Name() string // e.g. "json"
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes values as JSON using encoding/json. This is the default codec.
+var JSONCodec Codec = jsonCodec{}
+
+// GobCodec encodes values in a compact binary format using encoding/gob.
+// Values must conform to the requirements of encoding/gob, e.g. nil values can not be encoded.
+var GobCodec Codec = gobCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Codecs which are listed in capability announcements, besides the socket's own codec
+var knownCodecs = []Codec{JSONCodec, GobCodec}
+
+// codec returns the codec used by the socket. Safe to call on a nil socket.
+func (s *Sock) codec() Codec {
+	if s == nil {
+		return JSONCodec
+	}
+	if s.Codec != nil {
+		return s.Codec
+	}
+	if c := s.Handlers.codec(); c != nil {
+		return c
+	}
+	return JSONCodec
+}
+
+// codec returns the codec of h or any of its outer handlers, or nil if none is set
+func (h *Handlers) codec() Codec {
+	for ; h != nil; h = h.outer {
+		if h.Codec != nil {
+			return h.Codec
+		}
+	}
+	return nil
+}
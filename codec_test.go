@@ -0,0 +1,52 @@
+package gotalk
+
+import (
+	"testing"
+)
+
+type codecTestParams struct {
+	A, B int
+}
+
+func TestCodec(t *testing.T) {
+	h := &Handlers{Codec: GobCodec}
+	h.Handle("add", func(p codecTestParams) (int, error) {
+		return p.A + p.B, nil
+	})
+	received := make(chan codecTestParams, 1)
+	h.HandleNotification("note", func(p codecTestParams) {
+		received <- p
+	})
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	assertEq(t, GobCodec, s1.codec())
+
+	var sum int
+	if err := s1.Request("add", codecTestParams{1, 2}, &sum); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 3, sum)
+
+	// the payload should not be JSON
+	_, err = s1.BufferRequest("add", []byte(`{"A":1,"B":2}`))
+	assertError(t, "unexpected parameter type", err)
+
+	if err := s1.Notify("note", codecTestParams{3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, codecTestParams{3, 4}, <-received)
+
+	// sub handlers inherit the codec, which Sock.Codec overrides
+	h2 := h.NewSubHandlers()
+	s := NewSock(h2)
+	assertEq(t, GobCodec, s.codec())
+	s.Codec = JSONCodec
+	assertEq(t, JSONCodec, s.codec())
+	assertEq(t, JSONCodec, NewSock(&Handlers{}).codec())
+	assertEq(t, JSONCodec, (*Sock)(nil).codec())
+}
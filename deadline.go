@@ -0,0 +1,37 @@
+package gotalk
+
+import (
+	"context"
+	"time"
+)
+
+// Request deadlines.
+//
+// A requestor whose context has a deadline tells the responder how long it's willing to wait
+// by sending a MsgTypeReqDeadline message right before the request, with the time left in
+// milliseconds in its wait field. The time is relative so that the clocks of the two ends
+// don't need to agree. The responder doesn't start handling requests which have expired by
+// the time they would be dispatched, for instance after waiting in the request queue, and the
+// context of a handler has the request's deadline (see context.Context.Deadline.)
+// Deadlines are only sent to peers which support them (see capabilities.go.)
+
+// isExpired returns true if deadline is set and has passed
+func isExpired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// makeDeadlineMsg returns a deadline message for request id, or nil if ctx has no deadline or
+// the other end doesn't support deadlines
+func (s *Sock) makeDeadlineMsg(ctx context.Context, id string) []byte {
+	deadline, ok := ctx.Deadline()
+	if !ok || !s.peerSupports(capDeadline) {
+		return nil
+	}
+	timeout := time.Until(deadline) / time.Millisecond
+	if timeout < 0 {
+		timeout = 0
+	} else if timeout > 0xFFFFFFFF {
+		return nil // too far into the future to matter
+	}
+	return MakeMsg(MsgTypeReqDeadline, id, "", uint32(timeout), 0)
+}
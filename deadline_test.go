@@ -0,0 +1,95 @@
+package gotalk
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	h := &Handlers{}
+	release := make(chan struct{})
+	h.HandleBufferRequest("wait", func(s *Sock, op string, b []byte) ([]byte, error) {
+		<-release
+		return b, nil
+	})
+	h.HandleBufferRequestContext("deadline", func(
+		ctx context.Context, s *Sock, op string, b []byte) ([]byte, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return []byte("none"), nil
+		}
+		return []byte(time.Until(deadline).Round(time.Second).String()), nil
+	})
+	s1, s2, err := Pipe(h, &Limits{
+		BufferRequests: 1,
+		QueuedRequests: 1,
+		QueueWait:      time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// the handler's context has the requestor's deadline
+	buf, err := s1.BufferRequest("deadline", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "none", string(buf))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	buf, err = s1.BufferRequestContext(ctx, "deadline", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "5s", string(buf))
+
+	// a request which has already expired is not handled
+	send := func(ctx context.Context) Response {
+		t.Helper()
+		reschan := make(chan Response, 1)
+		if _, err := s1.sendRequest(ctx, NewRequest("deadline", nil), reschan); err != nil {
+			t.Fatal(err)
+		}
+		return <-reschan
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	res := send(ctx)
+	assertEq(t, true, res.IsError())
+	assertEq(t, ErrDeadlineExceeded.Error(), string(res.Data))
+
+	// nor is a request which expires while waiting in the queue
+	s1.SendRequest(NewRequest("wait", nil), make(chan Response, 1))
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	res = send(ctx)
+	assertEq(t, true, res.IsError())
+	assertEq(t, ErrDeadlineExceeded.Error(), string(res.Data))
+	close(release)
+}
+
+func TestRequestDeadlineConnected(t *testing.T) {
+	// deadlines are sent over connections made with Connect and Accept
+	h := &Handlers{}
+	h.HandleBufferRequestContext("deadline", func(
+		ctx context.Context, s *Sock, op string, b []byte) ([]byte, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return []byte("none"), nil
+		}
+		return []byte(time.Until(deadline).Round(time.Second).String()), nil
+	})
+	c, _ := connectTestServer(t, h, NoLimits)
+	assertEq(t, true, c.Capabilities().Has("deadline"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	buf, err := c.BufferRequestContext(ctx, "deadline", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "5s", string(buf))
+}
@@ -0,0 +1,104 @@
+package gotalk
+
+import (
+	"hash/fnv"
+	"runtime"
+)
+
+// NotificationDispatch controls how notification handlers are called. See Limits.
+type NotificationDispatch int
+
+const (
+	// Notification handlers are called one at a time by the goroutine reading from the socket,
+	// in the order notifications are received (the default.) A slow handler holds up all other
+	// messages received on the socket, including responses to the socket's own requests.
+	NotifyInline = NotificationDispatch(iota)
+
+	// Each notification handler is called in a goroutine of its own.
+	// Limits.Notifications limits the number of concurrent handlers (0=no limit.)
+	// Notifications are not necessarily handled in the order they are received.
+	NotifyConcurrent
+
+	// Notification handlers are called by a pool of Limits.Notifications worker goroutines
+	// (0=one per CPU.) Notifications with the same name are always handled by the same worker,
+	// and thus one at a time in the order they are received.
+	NotifyWorkerPool
+)
+
+// Number of notifications which may be waiting for each worker of a NotifyWorkerPool
+const notificationQueueSize = 64
+
+type noteJob struct {
+	handler BufferNoteHandler
+	name    string
+	buf     []byte
+}
+
+// noteDispatcher calls notification handlers of a socket according to its Limits
+type noteDispatcher struct {
+	s      *Sock
+	mode   NotificationDispatch
+	sem    chan struct{}  // NotifyConcurrent with a limit
+	queues []chan noteJob // NotifyWorkerPool
+}
+
+func newNoteDispatcher(s *Sock, lim *limitsImpl) *noteDispatcher {
+	d := &noteDispatcher{s: s, mode: lim.notifyDispatch}
+	switch d.mode {
+	case NotifyConcurrent:
+		if lim.notifyLimit > 0 {
+			d.sem = make(chan struct{}, lim.notifyLimit)
+		}
+	case NotifyWorkerPool:
+		n := int(lim.notifyLimit)
+		if n == 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		d.queues = make([]chan noteJob, n)
+		for i := range d.queues {
+			q := make(chan noteJob, notificationQueueSize)
+			d.queues[i] = q
+			s.handlerWg.Add(1)
+			go func() {
+				defer s.handlerWg.Done()
+				for job := range q {
+					s.callNotificationHandler(job.handler, job.name, job.buf)
+				}
+			}()
+		}
+	}
+	return d
+}
+
+// dispatch calls handler according to the dispatch mode. When the limit of concurrent
+// handlers has been reached, or the worker's queue is full, it waits. This holds up the
+// reading of further messages, which keeps memory usage bounded.
+func (d *noteDispatcher) dispatch(handler BufferNoteHandler, name string, buf []byte) {
+	switch d.mode {
+	case NotifyConcurrent:
+		if d.sem != nil {
+			d.sem <- struct{}{}
+		}
+		d.s.handlerWg.Add(1)
+		go func() {
+			defer d.s.handlerWg.Done()
+			if d.sem != nil {
+				defer func() { <-d.sem }()
+			}
+			d.s.callNotificationHandler(handler, name, buf)
+		}()
+	case NotifyWorkerPool:
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		d.queues[h.Sum32()%uint32(len(d.queues))] <- noteJob{handler, name, buf}
+	default:
+		d.s.callNotificationHandler(handler, name, buf)
+	}
+}
+
+// stop lets workers finish any queued notifications and exit. Must only be called once.
+func (d *noteDispatcher) stop() {
+	for _, q := range d.queues {
+		close(q)
+	}
+}
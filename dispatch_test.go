@@ -0,0 +1,118 @@
+package gotalk
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifyConcurrent(t *testing.T) {
+	h := &Handlers{}
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+	release := make(chan struct{})
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	h.HandleBufferNotification("slow", func(s *Sock, name string, b []byte) {
+		defer wg.Done()
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+	})
+
+	s1, s2, err := Pipe(h, &Limits{
+		BufferRequests:       Unlimited,
+		NotificationDispatch: NotifyConcurrent,
+		Notifications:        2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// two slow handlers don't hold up responses to s2's own requests
+	wg.Add(3)
+	s1.BufferNotify("slow", nil)
+	s1.BufferNotify("slow", nil)
+	waitFor(t, "handlers to start", func() bool { return atomic.LoadInt32(&running) == 2 })
+	b, err := s2.BufferRequest("echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "hello", string(b))
+
+	// a third has to wait for a slot
+	go s1.BufferNotify("slow", nil)
+	time.Sleep(10 * time.Millisecond)
+	assertEq(t, int32(2), atomic.LoadInt32(&running))
+	close(release)
+	wg.Wait()
+	assertEq(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
+
+func TestNotifyWorkerPool(t *testing.T) {
+	// pick two names which are handled by different workers
+	worker := func(name string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		return h.Sum32() % 2
+	}
+	slowName, fastName := "a", "b"
+	for i := 0; worker(slowName) == worker(fastName); i++ {
+		fastName = "b" + strconv.Itoa(i)
+	}
+
+	h := &Handlers{}
+	release := make(chan struct{})
+	h.HandleBufferNotification(slowName, func(s *Sock, name string, b []byte) {
+		<-release
+	})
+	var mu sync.Mutex
+	var received []int
+	h.HandleBufferNotification(fastName, func(s *Sock, name string, b []byte) {
+		n, _ := strconv.Atoi(string(b))
+		mu.Lock()
+		received = append(received, n)
+		mu.Unlock()
+	})
+
+	s1, s2, err := Pipe(h, &Limits{
+		NotificationDispatch: NotifyWorkerPool,
+		Notifications:        2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// a slow handler only holds up notifications handled by the same worker, and notifications
+	// with the same name are handled in order
+	s1.BufferNotify(slowName, nil)
+	const count = 100
+	for i := 0; i < count; i++ {
+		if err := s1.BufferNotify(fastName, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "notifications", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == count
+	})
+	close(release)
+	for i, n := range received {
+		assertEq(t, i, n)
+	}
+}
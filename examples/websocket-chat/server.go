@@ -45,22 +45,13 @@ type RoomMap map[string]*Room
 var (
 	rooms   RoomMap
 	roomsmu sync.RWMutex
-	socks   map[*gotalk.WebSocket]int
-	socksmu sync.RWMutex
+	gh      *gotalk.WebSocketServer // keeps track of connected sockets
 )
 
 func onConnect(s *gotalk.WebSocket) {
-	// Keep track of connected sockets
-	socksmu.Lock()
-	defer socksmu.Unlock()
-	socks[s] = 1
-
-	// When the connection closes, remove the socket from our lists of connected peers
+	// log a message when the connection closes
 	s.CloseHandler = func(s *gotalk.WebSocket, _ int) {
 		fmt.Printf("Peer %s diconnected\n", s)
-		socksmu.Lock()
-		defer socksmu.Unlock()
-		delete(socks, s)
 	}
 
 	// log a message when a peer connects
@@ -78,11 +69,7 @@ func onConnect(s *gotalk.WebSocket) {
 }
 
 func broadcast(name string, in interface{}) {
-	socksmu.RLock()
-	defer socksmu.RUnlock()
-	for s := range socks {
-		s.Notify(name, in)
-	}
+	gh.Broadcast(name, in)
 }
 
 func findRoom(name string) *Room {
@@ -117,7 +104,7 @@ func randomName() string {
 }
 
 func main() {
-	socks = make(map[*gotalk.WebSocket]int)
+	gh = gotalk.NewWebSocketServer()
 	rooms = make(RoomMap)
 
 	// Load names data
@@ -165,7 +152,6 @@ func main() {
 	})
 
 	// Serve gotalk at "/gotalk/"
-	gh := gotalk.WebSocketHandler()
 	gh.OnConnect = onConnect
 	routes := &http.ServeMux{}
 	server := &http.Server{Addr: "localhost:1235", Handler: routes}
@@ -191,10 +177,7 @@ func enableGracefulShutdown(server *http.Server, timeout time.Duration) chan str
 	server.RegisterOnShutdown(func() {
 		// close all connected sockets
 		fmt.Printf("graceful shutdown: closing sockets\n")
-		socksmu.RLock()
-		defer socksmu.RUnlock()
-		for s := range socks {
-			s.CloseHandler = nil // avoid deadlock on socksmu (also not needed)
+		for _, s := range gh.Sockets() {
 			s.Close()
 		}
 	})
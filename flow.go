@@ -0,0 +1,363 @@
+package gotalk
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Flow control for streaming requests and results.
+//
+// The receiver of a stream announces how many bytes of stream data it is willing to buffer
+// (Limits.StreamWindow) with a window update message and sends further window updates as the
+// data is consumed. A sender which has received a window update for a stream only sends while
+// it has credit left. A sender which has not received any window update, because the receiver
+// doesn't use flow control, is not limited. A window update of 0 tells the sender to stop
+// sending the stream altogether.
+//
+// The receiver's first window update must reach the sender before it sends much data, or the
+// receiver would have to buffer more than its window. A requestor therefore sends the window of
+// a stream's results right before the request, and waits for the responder's window before
+// sending further parameters if the responder has announced one in its capabilities.
+//
+// Incoming stream data is buffered in a streamQueue per stream so that the read loop, and
+// thereby other requests, notifications and heartbeats, doesn't wait for a slow consumer.
+
+// creditKey identifies the credit of an outgoing stream by the type of the window update
+// messages which add to it: MsgTypeStreamReqWindow for the parameters of requests we send and
+// MsgTypeStreamResWindow for the results of requests we handle.
+type creditKey struct {
+	t  MsgType
+	id string
+}
+
+// streamCredit limits how much data may be sent on a stream
+type streamCredit struct {
+	mu      sync.Mutex
+	credit  int64
+	limited bool          // true once the receiver has announced a window
+	closed  bool          // true when the stream has ended
+	wake    chan struct{} // signalled when credit is added or the stream is closed
+}
+
+func newStreamCredit() *streamCredit {
+	return &streamCredit{wake: make(chan struct{}, 1)}
+}
+
+func (c *streamCredit) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *streamCredit) add(n uint32) {
+	c.mu.Lock()
+	c.limited = true
+	c.credit += int64(n)
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *streamCredit) close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.signal()
+}
+
+// limit makes the sender wait for the receiver's window, which it has announced in its
+// capabilities but not yet granted
+func (c *streamCredit) limit() {
+	c.mu.Lock()
+	c.limited = true
+	c.mu.Unlock()
+}
+
+// take waits until there's credit left and then takes n bytes of it.
+// A part larger than the window is sent as soon as there's any credit at all, so credit may go
+// negative. Returns ErrStreamClosed if the stream ends and ctx.Err() if ctx is done.
+func (c *streamCredit) take(ctx context.Context, n int) error {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return ErrStreamClosed
+		}
+		if !c.limited || c.credit > 0 {
+			c.credit -= int64(n)
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// openCredit registers the credit of a stream we are about to send
+func (s *Sock) openCredit(t MsgType, id string) *streamCredit {
+	c := newStreamCredit()
+	s.creditsMu.Lock()
+	if s.credits == nil {
+		s.credits = make(map[creditKey]*streamCredit)
+	}
+	s.credits[creditKey{t, id}] = c
+	s.creditsMu.Unlock()
+	return c
+}
+
+// closeCredit ends a stream we are sending, waking up any writer waiting for credit
+func (s *Sock) closeCredit(t MsgType, id string) {
+	s.creditsMu.Lock()
+	c := s.credits[creditKey{t, id}]
+	delete(s.credits, creditKey{t, id})
+	s.creditsMu.Unlock()
+	if c != nil {
+		c.close()
+	}
+}
+
+// readWindowUpdate is called when the receiver of a stream we are sending grants more credit,
+// or, with n=0, tells us to stop sending
+func (s *Sock) readWindowUpdate(t MsgType, id string, n uint32, size int) error {
+	if err := s.readDiscard(size); err != nil {
+		return err
+	}
+	if n == 0 {
+		s.closeCredit(t, id)
+		return nil
+	}
+	s.creditsMu.Lock()
+	c := s.credits[creditKey{t, id}]
+	s.creditsMu.Unlock()
+	if c != nil { // else the stream has ended
+		c.add(n)
+	}
+	return nil
+}
+
+// closeStreams ends all flow controlled streams of a closed connection
+func (s *Sock) closeStreams() {
+	s.pendingReqMu.Lock()
+	for _, q := range s.reqQueues {
+		q.cancel()
+	}
+	s.reqQueues = nil
+	s.pendingReqMu.Unlock()
+
+	s.creditsMu.Lock()
+	for _, c := range s.credits {
+		c.close()
+	}
+	s.credits = nil
+	s.creditsMu.Unlock()
+}
+
+// streamWindow returns the flow control window of streams we receive (0 = no flow control)
+func (s *Sock) streamWindow() uint32 {
+	return atomic.LoadUint32(&s.streamWindowSize)
+}
+
+// peerWindow returns the flow control window which the other end has announced for streams it
+// receives (0 = no flow control or not yet known)
+func (s *Sock) peerWindow() uint32 {
+	return atomic.LoadUint32(&s.peerStreamWindow)
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// streamQueue buffers incoming stream data of one stream until it's been consumed.
+// The read loop pushes data onto the queue and a goroutine running run delivers it to the
+// consumer, granting the sender more credit as data is consumed.
+type streamQueue[T any] struct {
+	s      *Sock
+	id     string
+	wt     MsgType // type of window update messages to send
+	window int
+
+	mu    sync.Mutex
+	items []T
+	sizes []int
+	size  int // total size of items
+
+	wake  chan struct{} // signalled when an item is pushed
+	space chan struct{} // signalled when an item is popped
+	done  chan struct{} // closed by cancel
+	once  sync.Once
+}
+
+func newStreamQueue[T any](s *Sock, id string, wt MsgType, window uint32) *streamQueue[T] {
+	return &streamQueue[T]{
+		s:      s,
+		id:     id,
+		wt:     wt,
+		window: int(window),
+		wake:   make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// push adds v, of size bytes, to the queue. If the sender doesn't respect the window, push
+// waits for the consumer so that the queue's memory usage stays bounded.
+func (q *streamQueue[T]) push(v T, size int) {
+	for {
+		q.mu.Lock()
+		if q.size < q.window {
+			break
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.space:
+		case <-q.done:
+			return
+		}
+	}
+	q.items = append(q.items, v)
+	q.sizes = append(q.sizes, size)
+	q.size += size
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *streamQueue[T]) pop() (v T, size int, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return
+	}
+	v, size = q.items[0], q.sizes[0]
+	var zero T
+	q.items[0] = zero
+	q.items, q.sizes = q.items[1:], q.sizes[1:]
+	q.size -= size
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+	return v, size, true
+}
+
+// cancel stops delivery and discards any queued data
+func (q *streamQueue[T]) cancel() {
+	q.once.Do(func() { close(q.done) })
+}
+
+// run delivers queued items until deliver returns false, isLast returns true for a delivered
+// item or the queue is cancelled. deliver must give up when done is closed.
+func (q *streamQueue[T]) run(deliver func(v T, done <-chan struct{}) bool, isLast func(T) bool) {
+	consumed := 0
+	for {
+		v, size, ok := q.pop()
+		if !ok {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		if !deliver(v, q.done) || isLast(v) {
+			return
+		}
+		// grant more credit once half of the window has been consumed
+		consumed += size
+		if consumed > 0 && consumed >= q.window/2 {
+			if q.s.writeMsg(q.wt, q.id, "", uint32(consumed), nil) != nil {
+				return
+			}
+			consumed = 0
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// startReqQueue starts buffering the parameters of stream request id, delivering them to rch
+func (s *Sock) startReqQueue(id string, rch chan []byte, window uint32) *streamQueue[[]byte] {
+	q := newStreamQueue[[]byte](s, id, MsgTypeStreamReqWindow, window)
+	s.pendingReqMu.Lock()
+	if s.reqQueues == nil {
+		s.reqQueues = make(map[string]*streamQueue[[]byte])
+	}
+	s.reqQueues[id] = q
+	s.pendingReqMu.Unlock()
+	go func() {
+		// rch is closed here rather than by readCancel since we might be sending on it
+		defer close(rch)
+		q.run(func(b []byte, done <-chan struct{}) bool {
+			select {
+			case rch <- b:
+				return true
+			case <-done:
+				return false
+			}
+		}, func(b []byte) bool { return b == nil })
+	}()
+	return q
+}
+
+func (s *Sock) getReqQueue(id string) *streamQueue[[]byte] {
+	s.pendingReqMu.RLock()
+	defer s.pendingReqMu.RUnlock()
+	return s.reqQueues[id]
+}
+
+// endReqQueue stops buffering the parameters of stream request id
+func (s *Sock) endReqQueue(id string) bool {
+	s.pendingReqMu.Lock()
+	q := s.reqQueues[id]
+	delete(s.reqQueues, id)
+	s.pendingReqMu.Unlock()
+	if q != nil {
+		q.cancel()
+	}
+	return q != nil
+}
+
+// startResQueue starts buffering the results of stream request id which we are sending
+func (s *Sock) startResQueue(id string, window uint32) {
+	q := newStreamQueue[Response](s, id, MsgTypeStreamResWindow, window)
+	s.pendingResMu.Lock()
+	if s.resQueues == nil {
+		s.resQueues = make(map[string]*streamQueue[Response])
+	}
+	s.resQueues[id] = q
+	s.pendingResMu.Unlock()
+	go func() {
+		q.run(func(res Response, done <-chan struct{}) bool {
+			s.pendingResMu.Lock()
+			ch := s.pendingRes[id]
+			if ch != nil && isLastStreamRes(res) {
+				delete(s.pendingRes, id)
+			}
+			s.pendingResMu.Unlock()
+			if ch == nil {
+				return false
+			}
+			select {
+			case ch <- res:
+				return true
+			case <-done:
+				return false
+			}
+		}, isLastStreamRes)
+		s.pendingResMu.Lock()
+		if s.resQueues[id] == q {
+			delete(s.resQueues, id)
+		}
+		s.pendingResMu.Unlock()
+		q.cancel()
+	}()
+}
+
+func isLastStreamRes(res Response) bool {
+	return res.MsgType != MsgTypeStreamRes || len(res.Data) == 0
+}
@@ -0,0 +1,148 @@
+package gotalk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamFlowControl(t *testing.T) {
+	t.Run("Pipe", func(t *testing.T) {
+		testStreamFlowControl(t, func(h *Handlers, limits *Limits) *Sock {
+			s1, s2, err := Pipe(h, limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s1.Close(); s2.Close() })
+			return s1
+		})
+	})
+	t.Run("Connect", func(t *testing.T) {
+		testStreamFlowControl(t, func(h *Handlers, limits *Limits) *Sock {
+			s1, _ := connectTestServer(t, h, limits)
+			assertEq(t, true, s1.Capabilities().Has("flow"))
+			assertEq(t, limits.StreamWindow, s1.Capabilities().StreamWindow)
+			return s1
+		})
+	})
+}
+
+// testStreamFlowControl tests flow control between the socket returned by connect and its peer
+func testStreamFlowControl(t *testing.T, connect func(*Handlers, *Limits) *Sock) {
+	const window = 64
+	const total = 100 * window
+
+	h := &Handlers{}
+	h.HandleBufferRequest("ping", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+	unblock := make(chan struct{})
+	h.HandleStream("count", func(
+		ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error {
+		<-unblock // slow consumer
+		n, err := io.Copy(ioutil.Discard, in)
+		if err != nil {
+			return err
+		}
+		return out.Encode(n)
+	})
+	h.HandleStream("produce", func(
+		ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error {
+		part := bytes.Repeat([]byte("x"), window/4)
+		for n := 0; n < total; n += len(part) {
+			if _, err := out.Write(part); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	limits := &Limits{
+		BufferRequests: Unlimited,
+		StreamRequests: Unlimited,
+		StreamWindow:   window,
+	}
+	s1 := connect(h, limits)
+
+	ping := func() {
+		t.Helper()
+		b, err := s1.BufferRequest("ping", []byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, "ping", string(b))
+	}
+	ping() // make sure both sockets are reading
+
+	// a slow request handler doesn't hold up other requests
+	ctx := context.Background()
+	w, r := s1.OpenStream(ctx, "count")
+	var written int64
+	writeDone := make(chan error, 1)
+	go func() {
+		part := bytes.Repeat([]byte("x"), window/4)
+		for n := 0; n < total; n += len(part) {
+			if _, err := w.Write(part); err != nil {
+				writeDone <- err
+				return
+			}
+			atomic.AddInt64(&written, int64(len(part)))
+		}
+		writeDone <- w.Close()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ping()
+	if atomic.LoadInt64(&written) >= total {
+		t.Fatal("writer was not held back by flow control")
+	}
+	close(unblock)
+	if err := <-writeDone; err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := r.Next(&n); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, total, n)
+
+	// a slow result reader doesn't hold up other requests
+	w, r = s1.OpenStream(ctx, "produce")
+	w.Close()
+	time.Sleep(10 * time.Millisecond)
+	ping()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, total, len(b))
+
+	// closing the result reader early ends the stream
+	w, r = s1.OpenStream(ctx, "produce")
+	w.Close()
+	if _, err := r.ReadPart(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	ping()
+}
+
+func TestStreamCredit(t *testing.T) {
+	// streams are not limited until the receiver has announced a window
+	c := newStreamCredit()
+	assertEq(t, nil, c.take(context.Background(), 100))
+	// the window includes data sent before it was announced
+	c.add(200)
+	assertEq(t, nil, c.take(context.Background(), 50))
+	assertEq(t, nil, c.take(context.Background(), 100)) // parts may exceed the remaining credit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assertEq(t, context.DeadlineExceeded, c.take(ctx, 1))
+	c.add(100)
+	assertEq(t, nil, c.take(context.Background(), 1))
+	c.close()
+	assertEq(t, ErrStreamClosed, c.take(context.Background(), 1))
+}
@@ -1,5 +1,5 @@
 module github.com/rsms/gotalk
 
-go 1.15
+go 1.18
 
 require golang.org/x/net v0.0.0-20200930145003-4acb6c075d10
@@ -1,27 +1,56 @@
 package gotalk
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"reflect"
 	"sync"
+	"time"
 )
 
 // The Handlers struct contains request and notifications handlers.
 // Create a new set of handlers by simply creating a zero struct: `&Handlers{}`
 type Handlers struct {
+	// Codec used to encode and decode values for handlers registered with Handle and
+	// HandleNotification, and by sockets using these handlers, unless Sock.Codec is set.
+	// If nil, the Codec of outer handlers (see NewSubHandlers) or JSONCodec is used.
+	Codec Codec
+
 	bufReqHandlersMu      sync.RWMutex
 	bufReqHandlers        bufReqHandlerMap
-	bufReqFallbackHandler BufferReqHandler
+	bufReqFallbackHandler BufferReqContextHandler
 
 	streamReqHandlersMu      sync.RWMutex
 	streamReqHandlers        streamReqHandlerMap
-	streamReqFallbackHandler StreamReqHandler
+	streamReqFallbackHandler StreamReqContextHandler
+
+	notesMu                   sync.RWMutex
+	noteHandlers              noteHandlerMap
+	noteFallbackHandler       BufferNoteHandler
+	noteHeaderHandlers        map[string]BufferNoteHeaderHandler
+	noteFallbackHeaderHandler BufferNoteHeaderHandler
+
+	timeoutsMu      sync.RWMutex
+	timeouts        map[string]time.Duration
+	fallbackTimeout time.Duration
+
+	opLimitsMu sync.RWMutex
+	opLimits   map[string]*opLimiter
+
+	accessMu       sync.RWMutex
+	access         map[string]*OpAccess
+	fallbackAccess *OpAccess
+	accessPolicy   AccessPolicy
 
-	notesMu             sync.RWMutex
-	noteHandlers        noteHandlerMap
-	noteFallbackHandler BufferNoteHandler
+	middlewareMu        sync.RWMutex
+	bufReqMiddleware    []BufferReqMiddleware
+	streamReqMiddleware []StreamReqMiddleware
+	noteMiddleware      []NoteMiddleware
+
+	gen     uint32          // incremented when handlers or middleware change (atomic)
+	wrapped wrappedHandlers // handlers wrapped in middleware
 
 	outer *Handlers // if non-nil, this is searched when a local lookup fails
 }
@@ -33,17 +62,29 @@ func NewHandlers() *Handlers {
 }
 
 // If a handler panics, it's assumed that the effect of the panic was isolated to the active
-// request. Panic is recovered, a stack trace is logged, and connection is closed.
+// request. Panic is recovered and logged with HandlerErrorLogger and, for request handlers,
+// sent to the requestor as an error. This applies to all kinds of handlers.
 type BufferReqHandler func(s *Sock, op string, payload []byte) ([]byte, error)
 type BufferNoteHandler func(s *Sock, name string, payload []byte)
 
 // EOS when <-rch==nil
 type StreamReqHandler func(s *Sock, name string, rch chan []byte, out io.WriteCloser) error
 
+// BufferReqContextHandler is like BufferReqHandler but also receives a context which is
+// cancelled when the requestor cancels the request, when the socket closes or when the
+// operation's timeout passes (see Handlers.SetTimeout.)
+type BufferReqContextHandler func(
+	ctx context.Context, s *Sock, op string, payload []byte) ([]byte, error)
+
+// StreamReqContextHandler is like StreamReqHandler but also receives a context.
+// See BufferReqContextHandler for details.
+type StreamReqContextHandler func(
+	ctx context.Context, s *Sock, name string, rch chan []byte, out io.WriteCloser) error
+
 // Default handlers, manipulated by the package-level handle functions like HandleBufferRequest
 var DefaultHandlers = &Handlers{}
 
-// Handle operation with automatic JSON encoding of values.
+// Handle operation with automatic encoding of values (JSON by default; see Codec.)
 //
 // `fn` must conform to one of the following signatures:
 //   func(*Sock, string, interface{}) (interface{}, error) -- takes socket, op and parameters
@@ -59,6 +100,10 @@ var DefaultHandlers = &Handlers{}
 //   func(interface{}) error
 //   func() error
 //
+// Any of the above signatures may also take a context.Context as the first argument, e.g:
+//   func(context.Context, *Sock, interface{}) (interface{}, error)
+// See BufferReqContextHandler for details on the context.
+//
 // If `op` is empty, handle all requests which doesn't have a specific handler registered.
 func Handle(op string, fn interface{}) {
 	DefaultHandlers.Handle(op, fn)
@@ -70,13 +115,27 @@ func HandleBufferRequest(op string, fn BufferReqHandler) {
 	DefaultHandlers.HandleBufferRequest(op, fn)
 }
 
+// Handle operation with raw input and output buffers and a context.
+// If `op` is empty, handle all requests which doesn't have a specific handler registered.
+func HandleBufferRequestContext(op string, fn BufferReqContextHandler) {
+	DefaultHandlers.HandleBufferRequestContext(op, fn)
+}
+
 // Handle operation by reading and writing directly from/to the underlying stream.
 // If `op` is empty, handle all requests which doesn't have a specific handler registered.
 func HandleStreamRequest(op string, fn StreamReqHandler) {
 	DefaultHandlers.HandleStreamRequest(op, fn)
 }
 
-// Handle notifications of a certain name with automatic JSON encoding of values.
+// Handle operation by reading and writing directly from/to the underlying stream,
+// with a context. If `op` is empty, handle all requests which doesn't have a specific
+// handler registered.
+func HandleStreamRequestContext(op string, fn StreamReqContextHandler) {
+	DefaultHandlers.HandleStreamRequestContext(op, fn)
+}
+
+// Handle notifications of a certain name with automatic encoding of values
+// (JSON by default; see Codec.)
 //
 // `fn` must conform to one of the following signatures:
 //   func(s *Sock, name string, v interface{}) -- takes socket, name and parameters
@@ -97,8 +156,8 @@ func HandleBufferNotification(name string, fn BufferNoteHandler) {
 
 // -------------------------------------------------------------------------------------
 
-type bufReqHandlerMap map[string]BufferReqHandler
-type streamReqHandlerMap map[string]StreamReqHandler
+type bufReqHandlerMap map[string]BufferReqContextHandler
+type streamReqHandlerMap map[string]StreamReqContextHandler
 type noteHandlerMap map[string]BufferNoteHandler
 
 // NewSubHandlers returns a new Handlers object which wraps the receiver.
@@ -109,7 +168,7 @@ func (h *Handlers) NewSubHandlers() *Handlers {
 	return &Handlers{outer: h}
 }
 
-// Handle operation with automatic JSON encoding of values.
+// Handle operation with automatic encoding of values (JSON by default; see Codec.)
 //
 // `fn` must conform to one of the following signatures:
 //   func(*Sock, string, interface{}) (interface{}, error) -- takes socket, op and parameters
@@ -125,16 +184,30 @@ func (h *Handlers) NewSubHandlers() *Handlers {
 //   func(interface{}) error
 //   func() error
 //
+// Any of the above signatures may also take a context.Context as the first argument, e.g:
+//   func(context.Context, *Sock, interface{}) (interface{}, error)
+// See BufferReqContextHandler for details on the context.
+//
 // If `op` is empty, handle all requests which doesn't have a specific handler registered.
 func (h *Handlers) Handle(op string, fn interface{}) {
-	h.HandleBufferRequest(op, wrapFuncReqHandler(fn))
+	h.HandleBufferRequestContext(op, wrapFuncReqHandler(fn))
 }
 
 // Handle operation with raw input and output buffers. If `op` is empty, handle
 // all requests which doesn't have a specific handler registered.
 func (h *Handlers) HandleBufferRequest(op string, fn BufferReqHandler) {
+	h.HandleBufferRequestContext(op, func(
+		_ context.Context, s *Sock, op string, payload []byte) ([]byte, error) {
+		return fn(s, op, payload)
+	})
+}
+
+// Handle operation with raw input and output buffers and a context.
+// If `op` is empty, handle all requests which doesn't have a specific handler registered.
+func (h *Handlers) HandleBufferRequestContext(op string, fn BufferReqContextHandler) {
 	h.bufReqHandlersMu.Lock()
 	defer h.bufReqHandlersMu.Unlock()
+	defer h.changed()
 	if len(op) == 0 {
 		h.bufReqFallbackHandler = fn
 	} else {
@@ -148,8 +221,19 @@ func (h *Handlers) HandleBufferRequest(op string, fn BufferReqHandler) {
 // Handle operation by reading and writing directly from/to the underlying stream.
 // If `op` is empty, handle all requests which doesn't have a specific handler registered.
 func (h *Handlers) HandleStreamRequest(op string, fn StreamReqHandler) {
+	h.HandleStreamRequestContext(op, func(
+		_ context.Context, s *Sock, name string, rch chan []byte, out io.WriteCloser) error {
+		return fn(s, name, rch, out)
+	})
+}
+
+// Handle operation by reading and writing directly from/to the underlying stream,
+// with a context. If `op` is empty, handle all requests which doesn't have a specific
+// handler registered.
+func (h *Handlers) HandleStreamRequestContext(op string, fn StreamReqContextHandler) {
 	h.streamReqHandlersMu.Lock()
 	defer h.streamReqHandlersMu.Unlock()
+	defer h.changed()
 	if len(op) == 0 {
 		h.streamReqFallbackHandler = fn
 	} else {
@@ -160,7 +244,8 @@ func (h *Handlers) HandleStreamRequest(op string, fn StreamReqHandler) {
 	}
 }
 
-// Handle notifications of a certain name with automatic JSON encoding of values.
+// Handle notifications of a certain name with automatic encoding of values
+// (JSON by default; see Codec.)
 //
 // `fn` must conform to one of the following signatures:
 //   func(s *Sock, name string, v interface{}) -- takes socket, name and parameters
@@ -178,51 +263,131 @@ func (h *Handlers) HandleNotification(name string, fn interface{}) {
 func (h *Handlers) HandleBufferNotification(name string, fn BufferNoteHandler) {
 	h.notesMu.Lock()
 	defer h.notesMu.Unlock()
+	defer h.changed()
 	if len(name) == 0 {
 		h.noteFallbackHandler = fn
+		h.noteFallbackHeaderHandler = nil
 	} else {
 		if h.noteHandlers == nil {
 			h.noteHandlers = make(noteHandlerMap)
 		}
 		h.noteHandlers[name] = fn
+		delete(h.noteHeaderHandlers, name)
+	}
+}
+
+// SetTimeout sets the maximum amount of time a handler for operation `op` may take.
+// When the timeout passes, the context passed to the handler is cancelled.
+// If `op` is empty, the timeout applies to all operations which doesn't have a specific
+// timeout set. A timeout of 0 means "no timeout."
+func (h *Handlers) SetTimeout(op string, timeout time.Duration) {
+	h.timeoutsMu.Lock()
+	defer h.timeoutsMu.Unlock()
+	if len(op) == 0 {
+		h.fallbackTimeout = timeout
+	} else {
+		if h.timeouts == nil {
+			h.timeouts = make(map[string]time.Duration)
+		}
+		if timeout == 0 {
+			delete(h.timeouts, op)
+		} else {
+			h.timeouts[op] = timeout
+		}
 	}
 }
 
 // Look up a single-buffer handler for operation `op`. Returns `nil` if not found.
+// Handlers which take a context receive context.Background() when called via the
+// returned function.
 func (h *Handlers) FindBufferRequestHandler(op string) BufferReqHandler {
+	fn := h.FindBufferRequestContextHandler(op)
+	if fn == nil {
+		return nil
+	}
+	return func(s *Sock, op string, payload []byte) ([]byte, error) {
+		return fn(context.Background(), s, op, payload)
+	}
+}
+
+// Look up a single-buffer handler for operation `op`. Returns `nil` if not found.
+// The returned handler is wrapped in any middleware (see Use.)
+func (h *Handlers) FindBufferRequestContextHandler(op string) BufferReqContextHandler {
+	return h.findWrappedBufferRequestHandler(op)
+}
+
+func (h *Handlers) findBufferRequestHandler(op string) BufferReqContextHandler {
 	h.bufReqHandlersMu.RLock()
 	defer h.bufReqHandlersMu.RUnlock()
 	if handler := h.bufReqHandlers[op]; handler != nil {
 		return handler
 	}
 	if h.outer != nil {
-		return h.outer.FindBufferRequestHandler(op)
+		return h.outer.findBufferRequestHandler(op)
 	}
 	return h.bufReqFallbackHandler
 }
 
 // Look up a stream handler for operation `op`. Returns `nil` if not found.
+// Handlers which take a context receive context.Background() when called via the
+// returned function.
 func (h *Handlers) FindStreamRequestHandler(op string) StreamReqHandler {
+	fn := h.FindStreamRequestContextHandler(op)
+	if fn == nil {
+		return nil
+	}
+	return func(s *Sock, name string, rch chan []byte, out io.WriteCloser) error {
+		return fn(context.Background(), s, name, rch, out)
+	}
+}
+
+// Look up a stream handler for operation `op`. Returns `nil` if not found.
+// The returned handler is wrapped in any middleware (see Use.)
+func (h *Handlers) FindStreamRequestContextHandler(op string) StreamReqContextHandler {
+	return h.findWrappedStreamRequestHandler(op)
+}
+
+func (h *Handlers) findStreamRequestHandler(op string) StreamReqContextHandler {
 	h.streamReqHandlersMu.RLock()
 	defer h.streamReqHandlersMu.RUnlock()
 	if handler := h.streamReqHandlers[op]; handler != nil {
 		return handler
 	}
 	if h.outer != nil {
-		return h.outer.FindStreamRequestHandler(op)
+		return h.outer.findStreamRequestHandler(op)
 	}
 	return h.streamReqFallbackHandler
 }
 
+// findTimeout returns the timeout for operation `op`, or 0 if there's no timeout
+func (h *Handlers) findTimeout(op string) time.Duration {
+	h.timeoutsMu.RLock()
+	defer h.timeoutsMu.RUnlock()
+	if timeout, ok := h.timeouts[op]; ok {
+		return timeout
+	}
+	if h.outer != nil {
+		if timeout := h.outer.findTimeout(op); timeout != 0 {
+			return timeout
+		}
+	}
+	return h.fallbackTimeout
+}
+
 // Look up a handler for notification `name`. Returns `nil` if not found.
+// The returned handler is wrapped in any middleware (see Use.)
 func (h *Handlers) FindNotificationHandler(name string) BufferNoteHandler {
+	return h.findWrappedNotificationHandler(name)
+}
+
+func (h *Handlers) findNotificationHandler(name string) BufferNoteHandler {
 	h.notesMu.RLock()
 	defer h.notesMu.RUnlock()
 	if handler := h.noteHandlers[name]; handler != nil {
 		return handler
 	}
 	if h.outer != nil {
-		return h.outer.FindNotificationHandler(name)
+		return h.outer.findNotificationHandler(name)
 	}
 	return h.noteFallbackHandler
 }
@@ -233,8 +398,9 @@ var (
 	errMsgBadHandler       = "invalid handler signature (see https://pkg.go.dev/github.com/rsms/gotalk#Handlers)"
 	errUnexpectedParamType = errors.New("unexpected parameter type")
 
-	kErrorType = reflect.TypeOf(new(error)).Elem()
-	kSockType  = reflect.TypeOf(new(Sock)).Elem()
+	kErrorType   = reflect.TypeOf(new(error)).Elem()
+	kSockType    = reflect.TypeOf(new(Sock)).Elem()
+	kContextType = reflect.TypeOf(new(context.Context)).Elem()
 )
 
 func valToErr(r reflect.Value) error {
@@ -247,10 +413,10 @@ func valToErr(r reflect.Value) error {
 	return errors.New("error") // fixme
 }
 
-func decodeResult(r []reflect.Value) ([]byte, error) {
+func decodeResult(c Codec, r []reflect.Value) ([]byte, error) {
 	if len(r) == 2 {
 		if r[1].IsNil() {
-			return json.Marshal(r[0].Interface())
+			return c.Marshal(r[0].Interface())
 		} else {
 			return nil, valToErr(r[1])
 		}
@@ -261,10 +427,9 @@ func decodeResult(r []reflect.Value) ([]byte, error) {
 	}
 }
 
-func decodeParams(paramsType reflect.Type, inbuf []byte) (*reflect.Value, error) {
+func decodeParams(c Codec, paramsType reflect.Type, inbuf []byte) (*reflect.Value, error) {
 	paramsVal := reflect.New(paramsType)
-	params := paramsVal.Interface()
-	if err := json.Unmarshal(inbuf, &params); err != nil {
+	if err := c.Unmarshal(inbuf, paramsVal.Interface()); err != nil {
 		return &paramsVal, errUnexpectedParamType
 	}
 	return &paramsVal, nil
@@ -283,7 +448,22 @@ func typeIsSockPtr(t reflect.Type) (ok bool, sockPtrToValue sockPtrToValueFunc)
 	return false, nil
 }
 
-func wrapFuncReqHandler(fn interface{}) BufferReqHandler {
+func wrapFuncReqHandler(fn interface{}) BufferReqContextHandler {
+	handler, err := makeFuncReqHandler(fn)
+	if err != nil {
+		panic(err.Error())
+	}
+	return handler
+}
+
+// badHandlerError returns an error describing why a handler has an invalid signature
+func badHandlerError(reason string) error {
+	return fmt.Errorf("invalid handler signature: %s (see https://pkg.go.dev/github.com/rsms/gotalk#Handlers)",
+		reason)
+}
+
+// makeFuncReqHandler is like wrapFuncReqHandler but returns an error instead of panicking
+func makeFuncReqHandler(fn interface{}) (BufferReqContextHandler, error) {
 	// `fn` must conform to one of the following signatures:
 	//   func(*Sock, string, interface{}) (interface{}, error) -- takes socket, op and parameters
 	//   func(*Sock, interface{}) (interface{}, error)         -- takes socket and parameters
@@ -298,100 +478,122 @@ func wrapFuncReqHandler(fn interface{}) BufferReqHandler {
 	//   func(interface{}) error
 	//   func() error
 	//
+	// Any of the above may take a context.Context as the first argument.
+	//
 	// Note: decodeResult() handles both 1 and 2 return values
 
 	fnv := reflect.ValueOf(fn)
 	fnt := fnv.Type()
 
 	if fnt.Kind() != reflect.Func {
-		panic(errMsgBadHandler)
+		return nil, badHandlerError("not a function")
 	}
 
 	ninputs := fnt.NumIn()
 	noutputs := fnt.NumOut()
 
+	// optional leading context argument
+	inctx := 0
+	if ninputs > 0 && fnt.In(0) == kContextType {
+		inctx = 1
+		ninputs--
+	}
+
 	// conditions:
-	// - must have [0-3] inputs
+	// - must have [0-3] inputs (not counting context)
 	// - must have [1-2] outputs
 	// - last output must be an error type
-	if ninputs > 3 || noutputs < 1 || noutputs > 2 ||
-		fnt.Out(noutputs-1).Implements(kErrorType) == false {
-		panic(errMsgBadHandler)
+	if ninputs > 3 {
+		return nil, badHandlerError("too many arguments")
+	}
+	if noutputs < 1 || noutputs > 2 {
+		return nil, badHandlerError("must return one or two values")
+	}
+	if fnt.Out(noutputs-1).Implements(kErrorType) == false {
+		return nil, badHandlerError("last return value must be an error")
 	}
 
 	in0IsSockPtr := false
 	var sockPtrToValue sockPtrToValueFunc
 	if ninputs > 0 {
-		in0IsSockPtr, sockPtrToValue = typeIsSockPtr(fnt.In(0))
+		in0IsSockPtr, sockPtrToValue = typeIsSockPtr(fnt.In(inctx))
 		if in0IsSockPtr == false && ninputs > 1 {
-			panic(errMsgBadHandler)
+			return nil, badHandlerError("first argument must be a *Sock")
+		}
+	}
+
+	// call calls fn with args, prepended by ctx if fn takes a context
+	call := func(ctx context.Context, args ...reflect.Value) []reflect.Value {
+		if inctx != 0 {
+			args = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, args...)
 		}
+		return fnv.Call(args)
 	}
 
 	if ninputs == 3 {
 		// `func(*Sock, string, interface{}) (interface{}, error)`
-		if fnt.In(1).Kind() != reflect.String {
-			panic(errMsgBadHandler)
+		if fnt.In(inctx+1).Kind() != reflect.String {
+			return nil, badHandlerError("second argument must be a string")
 		}
-		paramsType := fnt.In(2)
-		return func(s *Sock, op string, inbuf []byte) ([]byte, error) {
-			paramsVal, err := decodeParams(paramsType, inbuf)
+		paramsType := fnt.In(inctx + 2)
+		return func(ctx context.Context, s *Sock, op string, inbuf []byte) ([]byte, error) {
+			paramsVal, err := decodeParams(s.codec(), paramsType, inbuf)
 			if err != nil {
 				return nil, err
 			}
-			r := fnv.Call([]reflect.Value{sockPtrToValue(s), reflect.ValueOf(op), paramsVal.Elem()})
-			return decodeResult(r)
-		}
+			r := call(ctx, sockPtrToValue(s), reflect.ValueOf(op), paramsVal.Elem())
+			return decodeResult(s.codec(), r)
+		}, nil
 
 	} else if ninputs == 2 {
 		// Signature: `func(*Sock, interface{})(interface{}, error)`
-		paramsType := fnt.In(1)
-		return func(s *Sock, _ string, inbuf []byte) ([]byte, error) {
-			paramsVal, err := decodeParams(paramsType, inbuf)
+		paramsType := fnt.In(inctx + 1)
+		return func(ctx context.Context, s *Sock, _ string, inbuf []byte) ([]byte, error) {
+			paramsVal, err := decodeParams(s.codec(), paramsType, inbuf)
 			if err != nil {
 				return nil, err
 			}
-			r := fnv.Call([]reflect.Value{sockPtrToValue(s), paramsVal.Elem()})
-			return decodeResult(r)
-		}
+			r := call(ctx, sockPtrToValue(s), paramsVal.Elem())
+			return decodeResult(s.codec(), r)
+		}, nil
 
 	} else if ninputs == 1 {
 		if in0IsSockPtr {
 			// Signature: `func(*Sock)(interface{}, error)`
-			return func(s *Sock, _ string, _ []byte) ([]byte, error) {
-				r := fnv.Call([]reflect.Value{sockPtrToValue(s)})
-				return decodeResult(r)
-			}
+			return func(ctx context.Context, s *Sock, _ string, _ []byte) ([]byte, error) {
+				r := call(ctx, sockPtrToValue(s))
+				return decodeResult(s.codec(), r)
+			}, nil
 		}
 		// Signature: `func(interface{})(interface{}, error)`
-		paramsType := fnt.In(0)
-		return func(_ *Sock, _ string, inbuf []byte) ([]byte, error) {
-			paramsVal, err := decodeParams(paramsType, inbuf)
+		paramsType := fnt.In(inctx)
+		return func(ctx context.Context, s *Sock, _ string, inbuf []byte) ([]byte, error) {
+			paramsVal, err := decodeParams(s.codec(), paramsType, inbuf)
 			if err != nil {
 				return nil, err
 			}
-			r := fnv.Call([]reflect.Value{paramsVal.Elem()})
-			return decodeResult(r)
-		}
+			r := call(ctx, paramsVal.Elem())
+			return decodeResult(s.codec(), r)
+		}, nil
 	}
 
 	// no inputs
 
-	if noutputs == 2 {
-		// Signature: `func()(interface{},error)`
-		return func(_ *Sock, _ string, _ []byte) ([]byte, error) {
-			r := fnv.Call(nil)
-			return decodeResult(r)
-		}
+	if noutputs == 2 || inctx != 0 {
+		// Signature: `func()(interface{},error)` or `func(context.Context)error`
+		return func(ctx context.Context, s *Sock, _ string, _ []byte) ([]byte, error) {
+			r := call(ctx)
+			return decodeResult(s.codec(), r)
+		}, nil
 	} else {
 		// Signature: `func()error`
 		f, ok := fn.(func() error)
 		if ok == false {
-			panic(errMsgBadHandler)
+			return nil, badHandlerError("return value must be of type error")
 		}
-		return func(_ *Sock, _ string, _ []byte) ([]byte, error) {
+		return func(_ context.Context, _ *Sock, _ string, _ []byte) ([]byte, error) {
 			return nil, f()
-		}
+		}, nil
 	}
 }
 
@@ -423,7 +625,7 @@ func wrapFuncNotHandler(fn interface{}) BufferNoteHandler {
 		}
 		paramsType := fnt.In(2)
 		return func(s *Sock, name string, inbuf []byte) {
-			paramsVal, _ := decodeParams(paramsType, inbuf)
+			paramsVal, _ := decodeParams(s.codec(), paramsType, inbuf)
 			fnv.Call([]reflect.Value{sockPtrToValue(s), reflect.ValueOf(name), paramsVal.Elem()})
 		}
 	} else if ninputs == 2 {
@@ -432,15 +634,15 @@ func wrapFuncNotHandler(fn interface{}) BufferNoteHandler {
 			panic(errMsgBadHandler)
 		}
 		paramsType := fnt.In(1)
-		return func(_ *Sock, name string, inbuf []byte) {
-			paramsVal, _ := decodeParams(paramsType, inbuf)
+		return func(s *Sock, name string, inbuf []byte) {
+			paramsVal, _ := decodeParams(s.codec(), paramsType, inbuf)
 			fnv.Call([]reflect.Value{reflect.ValueOf(name), paramsVal.Elem()})
 		}
 	} else if ninputs == 1 {
 		// Signature: `func(interface{})`
 		paramsType := fnt.In(0)
-		return func(_ *Sock, _ string, inbuf []byte) {
-			paramsVal, _ := decodeParams(paramsType, inbuf)
+		return func(s *Sock, _ string, inbuf []byte) {
+			paramsVal, _ := decodeParams(s.codec(), paramsType, inbuf)
 			fnv.Call([]reflect.Value{paramsVal.Elem()})
 		}
 	}
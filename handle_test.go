@@ -2,8 +2,10 @@ package gotalk
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"testing"
+	"time"
 )
 
 func checkReqHandler(t *testing.T, s *Sock, h *Handlers, name, input, expectedOutput string) {
@@ -86,6 +88,34 @@ func TestRequestFuncHandlers(t *testing.T) {
 		invocationCount++
 		return nil
 	})
+	// Same signatures but with a context as the first argument
+	h.Handle("ctx-a", func(ctx context.Context, s *Sock, op string, p int) (int, error) {
+		if ctx == nil {
+			t.Errorf("nil context")
+		}
+		invocationCount++
+		return p + 1, nil
+	})
+	h.Handle("ctx-b", func(ctx context.Context, s *Sock, p int) (int, error) {
+		invocationCount++
+		return p + 1, nil
+	})
+	h.Handle("ctx-c", func(ctx context.Context, p int) (int, error) {
+		invocationCount++
+		return p + 1, nil
+	})
+	h.Handle("ctx-d", func(ctx context.Context, s *Sock) error {
+		invocationCount++
+		return nil
+	})
+	h.Handle("ctx-e", func(ctx context.Context) (int, error) {
+		invocationCount++
+		return 1, nil
+	})
+	h.Handle("ctx-f", func(ctx context.Context) error {
+		invocationCount++
+		return nil
+	})
 	h.Handle("", func(s *Sock, op string, p int) error {
 		if op != "fallback1" && op != "fallback2" {
 			t.Errorf("expected op='fallback1'||'fallback2' but got '%s'", op)
@@ -107,10 +137,16 @@ func TestRequestFuncHandlers(t *testing.T) {
 	checkReqHandler(t, s, h, "h", "1", "")
 	checkReqHandler(t, s, h, "i", "", "")
 	checkReqHandler(t, s, h, "j", "", "")
+	checkReqHandler(t, s, h, "ctx-a", "1", "2")
+	checkReqHandler(t, s, h, "ctx-b", "1", "2")
+	checkReqHandler(t, s, h, "ctx-c", "1", "2")
+	checkReqHandler(t, s, h, "ctx-d", "", "")
+	checkReqHandler(t, s, h, "ctx-e", "", "1")
+	checkReqHandler(t, s, h, "ctx-f", "", "")
 	checkReqHandler(t, s, h, "fallback1", "1", "")
 	checkReqHandler(t, s, h, "fallback2", "1", "")
 
-	if invocationCount != 12 {
+	if invocationCount != 18 {
 		t.Error("not all handlers were invoked")
 	}
 }
@@ -178,6 +214,33 @@ func TestPkgLevelHandlers(t *testing.T) {
 		out.Close()
 		return nil
 	})
+	HandleBufferRequestContext("b", func(
+		ctx context.Context, s *Sock, op string, payload []byte) ([]byte, error) {
+		return nil, nil
+	})
+	HandleStreamRequestContext("b", func(
+		ctx context.Context, s *Sock, name string, rch chan []byte, out io.WriteCloser) error {
+		return nil
+	})
 	HandleNotification("a", func() {})
 	HandleBufferNotification("a", func(s *Sock, name string, payload []byte) {})
 }
+
+func TestHandlerTimeouts(t *testing.T) {
+	h := &Handlers{}
+	h.SetTimeout("", time.Second)
+	h.SetTimeout("a", 2*time.Second)
+	assertEq(t, 2*time.Second, h.findTimeout("a"))
+	assertEq(t, time.Second, h.findTimeout("b"))
+
+	// sub handlers inherit timeouts
+	h2 := h.NewSubHandlers()
+	h2.SetTimeout("b", 3*time.Second)
+	assertEq(t, 2*time.Second, h2.findTimeout("a"))
+	assertEq(t, 3*time.Second, h2.findTimeout("b"))
+	assertEq(t, time.Second, h2.findTimeout("c"))
+
+	// 0 removes the timeout
+	h.SetTimeout("a", 0)
+	assertEq(t, time.Second, h.findTimeout("a"))
+}
@@ -0,0 +1,258 @@
+package gotalk
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Header holds metadata of a request, response or notification, like authentication tokens,
+// trace IDs or locales, as key-value pairs. Keys are case sensitive.
+//
+// A header is sent in a MsgTypeHeader message right before the message it belongs to, and
+// only to peers which support headers (see capabilities.go.) Whether they do is known once
+// their capabilities announcement has been read, right after connecting; headers of messages
+// sent before then are dropped. The header of the results of a streaming request is sent with
+// the first result.
+type Header map[string]string
+
+// ErrHeaderTooLarge is returned when sending a header with a key longer than 4095 bytes, or a
+// value or header as a whole larger than 4294967295 bytes, which the protocol can't encode
+var ErrHeaderTooLarge = errors.New("header too large")
+
+const (
+	maxHeaderKeySize  = 0xFFF      // text3Size
+	maxHeaderDataSize = 0xFFFFFFFF // valueSize and payloadSize
+)
+
+// ContextWithHeader returns a copy of ctx which carries header. Requests sent with the
+// returned context, e.g. with Sock.BufferRequestContext, send header to the responder.
+// Sending fails with ErrHeaderTooLarge if header can't be encoded. See also Request.Header.
+func ContextWithHeader(ctx context.Context, header Header) context.Context {
+	return context.WithValue(ctx, outHeaderKey, header)
+}
+
+// RequestHeader returns the header of the request being handled, given the context passed to
+// its handler. Returns nil if the request has no header.
+func RequestHeader(ctx context.Context) Header {
+	h, _ := ctx.Value(reqHeaderKey).(Header)
+	return h
+}
+
+// ResponseHeader returns the header to be sent with the response to the request being
+// handled, given the context passed to its handler. Handlers may add to it. Handlers of
+// streaming requests must do so before writing their first result, which the header is sent
+// with. The requestor finds the header in Response.Header, or with StreamReader.Header.
+func ResponseHeader(ctx context.Context) Header {
+	h, _ := ctx.Value(resHeaderKey).(Header)
+	return h
+}
+
+type headerKey int
+
+const (
+	outHeaderKey = headerKey(iota) // header to send with requests (ContextWithHeader)
+	reqHeaderKey                   // header of the request being handled
+	resHeaderKey                   // header to send with the response of the request being handled
+)
+
+// BufferNoteHeaderHandler is like BufferNoteHandler but also receives the notification's header
+type BufferNoteHeaderHandler func(s *Sock, name string, header Header, payload []byte)
+
+// HandleBufferNotificationHeader is like HandleBufferNotification but the handler also
+// receives the notification's header. Any middleware (see Use) applies as usual.
+func (h *Handlers) HandleBufferNotificationHeader(name string, fn BufferNoteHeaderHandler) {
+	h.HandleBufferNotification(name, func(s *Sock, name string, payload []byte) {
+		fn(s, name, nil, payload)
+	})
+	h.notesMu.Lock()
+	defer h.notesMu.Unlock()
+	if len(name) == 0 {
+		h.noteFallbackHeaderHandler = fn
+	} else {
+		if h.noteHeaderHandlers == nil {
+			h.noteHeaderHandlers = make(map[string]BufferNoteHeaderHandler)
+		}
+		h.noteHeaderHandlers[name] = fn
+	}
+}
+
+// HandleBufferNotificationHeader is like HandleBufferNotification but the handler also
+// receives the notification's header.
+func HandleBufferNotificationHeader(name string, fn BufferNoteHeaderHandler) {
+	DefaultHandlers.HandleBufferNotificationHeader(name, fn)
+}
+
+// findNotificationHeaderHandler returns the handler which findNotificationHandler would find
+// if it was registered with HandleBufferNotificationHeader, or else nil
+func (h *Handlers) findNotificationHeaderHandler(name string) BufferNoteHeaderHandler {
+	h.notesMu.RLock()
+	defer h.notesMu.RUnlock()
+	if handler := h.noteHandlers[name]; handler != nil {
+		return h.noteHeaderHandlers[name]
+	}
+	if h.outer != nil {
+		return h.outer.findNotificationHeaderHandler(name)
+	}
+	if h.noteFallbackHandler != nil {
+		return h.noteFallbackHeaderHandler
+	}
+	return nil
+}
+
+// Middleware only passes on the payload of notifications, so the header of a notification is
+// looked up by its payload: withNoteHeader records header under the payload's underlying
+// array, which the wrapped header handler then finds with noteHeader.
+
+// withNoteHeader returns a handler which calls handler, a wrapped header handler, with buf and
+// makes header available to it for the duration of the call. buf is allocated if empty, to
+// give it an underlying array.
+func (s *Sock) withNoteHeader(
+	handler BufferNoteHandler, header Header, buf []byte,
+) (BufferNoteHandler, []byte) {
+	if cap(buf) == 0 {
+		buf = make([]byte, 0, 1)
+	}
+	key := payloadKey(buf)
+	s.noteHeaders.Store(key, header)
+	return func(s *Sock, name string, payload []byte) {
+		defer s.noteHeaders.Delete(key)
+		handler(s, name, payload)
+	}, buf
+}
+
+// noteHeader returns the header of the notification with payload which is being handled
+func (s *Sock) noteHeader(payload []byte) Header {
+	if key := payloadKey(payload); key != nil {
+		if header, ok := s.noteHeaders.Load(key); ok {
+			return header.(Header)
+		}
+	}
+	return nil
+}
+
+func payloadKey(payload []byte) *byte {
+	if cap(payload) == 0 {
+		return nil
+	}
+	return &payload[:1][0]
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// msgMeta holds metadata of a message which is announced by the messages preceding it
+type msgMeta struct {
+	deadline time.Time // MsgTypeReqDeadline
+	header   Header    // MsgTypeHeader
+	window   uint32    // MsgTypeStreamResWindow
+}
+
+// pendingMeta is the metadata of the next message read. It only applies if the message has
+// the same ID.
+type pendingMeta struct {
+	id string
+	msgMeta
+}
+
+// of returns the metadata of message id
+func (m *pendingMeta) of(id string) msgMeta {
+	if m.id == id {
+		return m.msgMeta
+	}
+	return msgMeta{}
+}
+
+// set returns the metadata to update for message id
+func (m *pendingMeta) set(id string) *msgMeta {
+	if m.id != id {
+		*m = pendingMeta{id: id}
+	}
+	return &m.msgMeta
+}
+
+// ID of header messages which belong to notifications, which don't have IDs themselves
+const noteHeaderID = "0000"
+
+// encodeHeader encodes h as a sequence of key-value pairs, each encoded as
+// text3Size text3Value valueSize value, e.g. "005trace0000000412ab"
+func encodeHeader(h Header) ([]byte, error) {
+	keys := make([]string, 0, len(h))
+	size := uint64(0)
+	for k, v := range h {
+		if len(k) > maxHeaderKeySize || uint64(len(v)) > maxHeaderDataSize {
+			return nil, ErrHeaderTooLarge
+		}
+		keys = append(keys, k)
+		size += uint64(3 + len(k) + 8 + len(v))
+	}
+	if size > maxHeaderDataSize {
+		return nil, ErrHeaderTooLarge
+	}
+	sort.Strings(keys) // for a stable encoding
+	b := make([]byte, size)
+	z := 0
+	for _, k := range keys {
+		v := h[k]
+		copyFixnum(b[z:z+3], 3, uint64(len(k)), 16)
+		z += 3
+		z += copy(b[z:], k)
+		copyFixnum(b[z:z+8], 8, uint64(len(v)), 16)
+		z += 8
+		z += copy(b[z:], v)
+	}
+	return b, nil
+}
+
+// decodeHeader decodes a header encoded by encodeHeader
+func decodeHeader(b []byte) (Header, error) {
+	h := Header{}
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrInvalidMsg
+		}
+		kz, err := strconv.ParseUint(string(b[:3]), 16, 16)
+		if err != nil || len(b) < 3+int(kz)+8 {
+			return nil, ErrInvalidMsg
+		}
+		k := string(b[3 : 3+kz])
+		b = b[3+kz:]
+		vz, err := strconv.ParseUint(string(b[:8]), 16, 32)
+		if err != nil || uint64(len(b)-8) < vz {
+			return nil, ErrInvalidMsg
+		}
+		h[k] = string(b[8 : 8+vz])
+		b = b[8+vz:]
+	}
+	return h, nil
+}
+
+// makeHeaderMsg returns a header message for message id and its payload, or nil if there's no
+// header to send. Returns ErrHeaderTooLarge if h can't be encoded, whether or not the other
+// end supports headers, and ErrPayloadTooLarge if the other end doesn't accept it.
+func (s *Sock) makeHeaderMsg(id string, h Header) ([][]byte, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+	block, err := encodeHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	if !s.peerSupports(capHeader) {
+		return nil, nil
+	}
+	if !s.peerAccepts(len(block)) {
+		return nil, ErrPayloadTooLarge
+	}
+	return [][]byte{MakeMsg(MsgTypeHeader, id, "", 0, uint32(len(block))), block}, nil
+}
+
+// readHeader is called when a header message is received
+func (s *Sock) readHeader(size int) (Header, error) {
+	buf := make([]byte, size)
+	if _, err := readn(s.conn, buf); err != nil {
+		return nil, err
+	}
+	return decodeHeader(buf)
+}
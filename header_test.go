@@ -0,0 +1,293 @@
+package gotalk
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeaderEncoding(t *testing.T) {
+	h := Header{"trace": "12ab", "locale": "sv-SE", "empty": ""}
+	b, err := encodeHeader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "005empty00000000006locale00000005sv-SE005trace0000000412ab", string(b))
+	h2, err := decodeHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 3, len(h2))
+	for k, v := range h {
+		assertEq(t, v, h2[k])
+	}
+
+	_, err = decodeHeader([]byte("005tra"))
+	assertEq(t, ErrInvalidMsg, err)
+	_, err = decodeHeader([]byte("005trace0000000512ab"))
+	assertEq(t, ErrInvalidMsg, err)
+	_, err = decodeHeader([]byte("xyz"))
+	assertEq(t, ErrInvalidMsg, err)
+
+	// keys which don't fit in text3Size
+	longKey := strings.Repeat("k", maxHeaderKeySize)
+	b, err = encodeHeader(Header{longKey: "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err = decodeHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "v", h2[longKey])
+	_, err = encodeHeader(Header{longKey + "k": "v"})
+	assertEq(t, ErrHeaderTooLarge, err)
+}
+
+func TestHeaderTooLarge(t *testing.T) {
+	tooLarge := Header{strings.Repeat("k", maxHeaderKeySize+1): "v"}
+	h := &Handlers{}
+	h.HandleBufferRequestContext("echo", func(
+		ctx context.Context, s *Sock, op string, b []byte,
+	) ([]byte, error) {
+		if string(b) == "large" {
+			for k, v := range tooLarge {
+				ResponseHeader(ctx)[k] = v
+			}
+		}
+		return b, nil
+	})
+	h.HandleStream("stream", func(
+		ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error {
+		for k, v := range tooLarge {
+			ResponseHeader(ctx)[k] = v
+		}
+		return out.Encode(1)
+	})
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// requests and notifications with headers which can't be encoded are not sent
+	r := NewRequest("echo", nil)
+	r.Header = tooLarge
+	assertEq(t, ErrHeaderTooLarge, s1.SendRequest(r, make(chan Response, 1)))
+	ctx := ContextWithHeader(context.Background(), tooLarge)
+	_, err = s1.BufferRequestContext(ctx, "echo", nil)
+	assertEq(t, ErrHeaderTooLarge, err)
+	assertEq(t, ErrHeaderTooLarge, s1.BufferNotifyHeader("msg", tooLarge, nil))
+
+	// nor are responses; the requestor gets an error instead
+	_, err = s1.BufferRequest("echo", []byte("large"))
+	assertError(t, "header too large", err)
+	w, r2 := s1.OpenStream(context.Background(), "stream")
+	w.Close()
+	var n int
+	assertError(t, "header too large", r2.Next(&n))
+
+	// the connection is still usable
+	b, err := s1.BufferRequest("echo", []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "hi", string(b))
+}
+
+func TestRequestHeader(t *testing.T) {
+	h := &Handlers{}
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+	h.HandleBufferRequestContext("whoami", func(
+		ctx context.Context, s *Sock, op string, b []byte,
+	) ([]byte, error) {
+		ResponseHeader(ctx)["trace"] = RequestHeader(ctx)["trace"]
+		return []byte(RequestHeader(ctx)["user"]), nil
+	})
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// Request.Header
+	r := NewRequest("whoami", nil)
+	r.Header = Header{"user": "robin", "trace": "t1"}
+	reschan := make(chan Response, 1)
+	if err := s1.SendRequest(r, reschan); err != nil {
+		t.Fatal(err)
+	}
+	res := <-reschan
+	assertEq(t, "robin", string(res.Data))
+	assertEq(t, "t1", res.Header["trace"])
+	assertEq(t, 1, len(res.Header))
+
+	// ContextWithHeader
+	ctx := ContextWithHeader(context.Background(), Header{"user": "sam"})
+	out, err := s1.BufferRequestContext(ctx, "whoami", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "sam", string(out))
+
+	// no header
+	reschan = make(chan Response, 1)
+	if err := s1.SendRequest(NewRequest("echo", []byte("hi")), reschan); err != nil {
+		t.Fatal(err)
+	}
+	res = <-reschan
+	assertEq(t, "hi", string(res.Data))
+	assertEq(t, 0, len(res.Header))
+}
+
+func TestStreamResponseHeader(t *testing.T) {
+	h := &Handlers{}
+	h.HandleStream("count", func(
+		ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error {
+		ResponseHeader(ctx)["trace"] = RequestHeader(ctx)["trace"]
+		for i := 0; i < 2; i++ {
+			if err := out.Encode(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// the header is sent with the first result
+	ctx := ContextWithHeader(context.Background(), Header{"trace": "t2"})
+	w, r := s1.OpenStream(ctx, "count")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 0, len(r.Header()))
+	var n int
+	if err := r.Next(&n); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "t2", r.Header()["trace"])
+	if err := r.Next(&n); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 1, n)
+	assertEq(t, "t2", r.Header()["trace"])
+}
+
+func TestNotificationHeader(t *testing.T) {
+	type note struct {
+		header  Header
+		payload string
+	}
+	notes := make(chan note, 3)
+	h := &Handlers{}
+	h.HandleBufferNotificationHeader("msg", func(s *Sock, name string, header Header, b []byte) {
+		notes <- note{header, string(b)}
+	})
+	var wraps int32
+	h.Use(func(next BufferNoteHandler) BufferNoteHandler {
+		atomic.AddInt32(&wraps, 1)
+		return next
+	})
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	if err := s1.BufferNotifyHeader("msg", Header{"from": "s1"}, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.BufferNotifyHeader("msg", Header{"from": "s2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.BufferNotify("msg", []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []note{{Header{"from": "s1"}, "hello"}, {Header{"from": "s2"}, ""}, {nil, "bye"}}
+	for _, expect := range expected {
+		select {
+		case n := <-notes:
+			assertEq(t, expect.payload, n.payload)
+			assertEq(t, len(expect.header), len(n.header))
+			assertEq(t, expect.header["from"], n.header["from"])
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for notification")
+		}
+	}
+
+	// middleware is applied once per kind of handler, not for every notification
+	assertEq(t, int32(2), atomic.LoadInt32(&wraps))
+}
+
+func TestHeaderConnected(t *testing.T) {
+	// headers are sent over connections made with Connect and Accept
+	h := &Handlers{}
+	h.HandleBufferRequestContext("whoami", func(
+		ctx context.Context, s *Sock, op string, b []byte,
+	) ([]byte, error) {
+		ResponseHeader(ctx)["trace"] = RequestHeader(ctx)["trace"]
+		return []byte(RequestHeader(ctx)["user"]), nil
+	})
+	notes := make(chan Header, 1)
+	h.HandleBufferNotificationHeader("msg", func(s *Sock, name string, header Header, b []byte) {
+		notes <- header
+	})
+	c, _ := connectTestServer(t, h, NoLimits)
+	assertEq(t, true, c.Capabilities().Has("header"))
+
+	r := NewRequest("whoami", nil)
+	r.Header = Header{"user": "robin", "trace": "t1"}
+	reschan := make(chan Response, 1)
+	if err := c.SendRequest(r, reschan); err != nil {
+		t.Fatal(err)
+	}
+	res := <-reschan
+	assertEq(t, "robin", string(res.Data))
+	assertEq(t, "t1", res.Header["trace"])
+
+	if err := c.BufferNotifyHeader("msg", Header{"from": "c"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case header := <-notes:
+		assertEq(t, "c", header["from"])
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+}
+
+func TestHeaderUnsupportedPeer(t *testing.T) {
+	h := &Handlers{}
+	h.HandleBufferRequestContext("whoami", func(
+		ctx context.Context, s *Sock, op string, b []byte,
+	) ([]byte, error) {
+		return []byte(RequestHeader(ctx)["user"]), nil
+	})
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	atomic.StoreUint32(&s1.peerCaps, 0)
+
+	// headers are not sent to peers which don't support them
+	ctx := ContextWithHeader(context.Background(), Header{"user": "sam"})
+	out, err := s1.BufferRequestContext(ctx, "whoami", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "", string(out))
+}
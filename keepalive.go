@@ -0,0 +1,296 @@
+package gotalk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnState describes the state of the connection of a socket connected with ConnectKeepAlive
+type ConnState int
+
+const (
+	ConnStateConnecting   = ConnState(iota) // dialing and performing the handshake
+	ConnStateConnected                      // connected and reading messages
+	ConnStateDisconnected                   // connection lost; waiting to reconnect
+	ConnStateClosed                         // the socket was closed and will not reconnect
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case ConnStateConnecting:
+		return "connecting"
+	case ConnStateConnected:
+		return "connected"
+	case ConnStateDisconnected:
+		return "disconnected"
+	case ConnStateClosed:
+		return "closed"
+	}
+	return "?"
+}
+
+// PendingRequestPolicy controls what happens to requests when the connection is lost
+type PendingRequestPolicy int
+
+const (
+	// Requests fail with an error when the connection is lost (the default)
+	PendingRequestsFail = PendingRequestPolicy(iota)
+
+	// Requests wait for the connection to be re-established and are then sent again.
+	// Note that a request which was sent just before the connection was lost might already
+	// have been handled by the peer, in which case it will be handled a second time.
+	PendingRequestsQueue
+)
+
+// KeepAlive configures a socket to stay connected by automatically reconnecting with
+// exponential back-off. See Sock.ConnectKeepAlive.
+type KeepAlive struct {
+	// Dial is called to establish a connection. Required.
+	// For example: func() (io.ReadWriteCloser, error) { return net.Dial("tcp", addr) }
+	Dial func() (io.ReadWriteCloser, error)
+
+	// Limits passed to Sock.Read for each connection. nil means DefaultLimits.
+	Limits *Limits
+
+	// Delay before the first reconnection attempt after a failure. Defaults to 500ms.
+	// If a connection is lost shortly after having been established, reconnecting is delayed
+	// so that at least MinDelay passes between two connection attempts.
+	MinDelay time.Duration
+
+	// The delay doubles with every failed attempt, up to MaxDelay. Defaults to 5s.
+	MaxDelay time.Duration
+
+	// What to do with BufferRequest calls when the connection is lost
+	PendingRequests PendingRequestPolicy
+
+	// If not nil, this function is called whenever the connection state changes.
+	// err is the reason for a transition to ConnStateDisconnected or ConnStateClosed and is nil
+	// if the connection was closed cleanly.
+	OnStateChange func(s *Sock, state ConnState, err error)
+}
+
+// keepAlive is the state of a socket connected with ConnectKeepAlive
+type keepAlive struct {
+	KeepAlive
+
+	mu      sync.Mutex
+	state   ConnState
+	conn    io.ReadWriteCloser // the connection established when state became ConnStateConnected
+	changed chan struct{}      // closed and replaced whenever state changes
+	stopped chan struct{}      // closed by stop()
+}
+
+// Connect to a server via `how` at `addr`, reconnecting whenever the connection is lost.
+// If ka is nil, the default KeepAlive configuration is used.
+// ka.Dial is ignored; use Sock.ConnectKeepAlive for custom dialing (e.g. TLS.)
+func ConnectKeepAlive(how, addr string, ka *KeepAlive) (*Sock, error) {
+	var c KeepAlive
+	if ka != nil {
+		c = *ka
+	}
+	c.Dial = func() (io.ReadWriteCloser, error) {
+		return net.Dial(how, addr)
+	}
+	s := NewSock(DefaultHandlers)
+	return s, s.ConnectKeepAlive(&c)
+}
+
+// Connect to a server using ka.Dial and stay connected by reconnecting with exponential
+// back-off whenever the connection is lost, until the socket is closed with Close,
+// CloseError or Shutdown. Each new connection performs the protocol handshake and is read
+// on a background goroutine. The socket retains its identity, Handlers and UserData across
+// connections. Note that CloseHandler is called every time a connection is lost.
+//
+// The first connection attempt is made before this function returns and if it fails,
+// its error is returned and the socket does not try to reconnect. Nor does it reconnect when
+// the server rejects its credentials (see Sock.AuthToken); OnStateChange is then called with
+// ConnStateClosed and ErrUnauthorized.
+func (s *Sock) ConnectKeepAlive(ka *KeepAlive) error {
+	if ka == nil || ka.Dial == nil {
+		return errors.New("KeepAlive.Dial is nil")
+	}
+	k := &keepAlive{
+		KeepAlive: *ka,
+		state:     ConnStateClosed,
+		changed:   make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if k.Limits == nil {
+		k.Limits = DefaultLimits
+	}
+	if k.MinDelay <= 0 {
+		k.MinDelay = 500 * time.Millisecond
+	}
+	if k.MaxDelay < k.MinDelay {
+		k.MaxDelay = 5 * time.Second
+		if k.MaxDelay < k.MinDelay {
+			k.MaxDelay = k.MinDelay
+		}
+	}
+	s.keepAlive = k
+
+	k.setState(s, ConnStateConnecting, nil, nil)
+	if err := k.connect(s); err != nil {
+		k.stop()
+		k.setState(s, ConnStateClosed, nil, err)
+		return err
+	}
+	go k.run(s)
+	return nil
+}
+
+// stopKeepAlive stops reconnecting. Called when the socket is closed by the user.
+func (s *Sock) stopKeepAlive() {
+	if k := s.keepAlive; k != nil {
+		k.stop()
+	}
+}
+
+func (k *keepAlive) stop() {
+	k.mu.Lock()
+	select {
+	case <-k.stopped:
+	default:
+		close(k.stopped)
+	}
+	k.mu.Unlock()
+}
+
+func (k *keepAlive) isStopped() bool {
+	select {
+	case <-k.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (k *keepAlive) setState(s *Sock, state ConnState, conn io.ReadWriteCloser, err error) {
+	k.mu.Lock()
+	k.state = state
+	k.conn = conn
+	close(k.changed)
+	k.changed = make(chan struct{})
+	k.mu.Unlock()
+	if k.OnStateChange != nil {
+		k.OnStateChange(s, state, err)
+	}
+}
+
+// connect dials, adopts the new connection and performs the handshake
+func (k *keepAlive) connect(s *Sock) error {
+	c, err := k.Dial()
+	if err != nil {
+		return err
+	}
+	// Hold mu while adopting so that a concurrent call to Close either sees and closes the new
+	// connection, or causes us to discard it.
+	k.mu.Lock()
+	if k.isStopped() {
+		k.mu.Unlock()
+		c.Close()
+		return ErrSockClosed
+	}
+	s.Adopt(c)
+	k.mu.Unlock()
+	if err := s.handshake(k.Limits); err != nil {
+		return err
+	}
+	k.setState(s, ConnStateConnected, c, nil)
+	return nil
+}
+
+// run reads the current connection and reconnects when it's lost
+func (k *keepAlive) run(s *Sock) {
+	for {
+		connectedAt := time.Now()
+		err := s.Read(k.Limits)
+		if err == io.EOF {
+			err = nil // closed cleanly
+		} else if err == ErrUnauthorized {
+			// the server rejected our credentials and will do so again if we reconnect
+			k.stop()
+		}
+		if k.isStopped() {
+			k.setState(s, ConnStateClosed, nil, err)
+			return
+		}
+		k.setState(s, ConnStateDisconnected, nil, err)
+
+		// If the connection was short-lived, wait so that we don't hammer the peer
+		var delay time.Duration
+		if err == ErrTimeout {
+			delay = 0
+		} else if _, ok := err.(net.Error); !ok && err != nil {
+			// Protocol error. It's unlikely that things will be different next time.
+			delay = k.MaxDelay
+		} else if d := time.Since(connectedAt); d < k.MinDelay {
+			delay = k.MinDelay - d
+		}
+
+		for {
+			if !k.sleep(delay) {
+				k.setState(s, ConnStateClosed, nil, nil)
+				return
+			}
+			k.setState(s, ConnStateConnecting, nil, nil)
+			err := k.connect(s)
+			if err == nil {
+				break
+			}
+			if k.isStopped() {
+				k.setState(s, ConnStateClosed, nil, err)
+				return
+			}
+			k.setState(s, ConnStateDisconnected, nil, err)
+			// increase back-off
+			if delay < k.MinDelay {
+				delay = k.MinDelay
+			} else if delay *= 2; delay > k.MaxDelay {
+				delay = k.MaxDelay
+			}
+		}
+	}
+}
+
+// sleep waits for d to pass. Returns false if k was stopped while waiting.
+func (k *keepAlive) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return !k.isStopped()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-k.stopped:
+		return false
+	}
+}
+
+// awaitConnection waits for a connection other than prev to be established.
+// Returns ErrSockClosed if k is stopped or ctx.Err() if ctx is done while waiting.
+func (k *keepAlive) awaitConnection(ctx context.Context, prev io.ReadWriteCloser) error {
+	for {
+		k.mu.Lock()
+		state, conn, changed := k.state, k.conn, k.changed
+		k.mu.Unlock()
+		if state == ConnStateConnected && conn != prev {
+			return nil
+		}
+		if state == ConnStateClosed {
+			return ErrSockClosed
+		}
+		select {
+		case <-changed:
+		case <-k.stopped:
+			return ErrSockClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
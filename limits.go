@@ -17,7 +17,8 @@ var DefaultLimits = &Limits{
 	StreamMaxWait:  5000 * time.Millisecond,
 }
 
-// NoLimits does not limit buffer requests or stream requests, nor does it have a read timeout.
+// NoLimits does not limit buffer requests or stream requests, nor does it have a read timeout
+// or a maximum payload size.
 var NoLimits = &Limits{
 	BufferRequests: Unlimited,
 	StreamRequests: Unlimited,
@@ -37,6 +38,52 @@ type Limits struct {
 
 	StreamMinWait time.Duration // minimum time to wait when StreamRequests has been reached
 	StreamMaxWait time.Duration // max time to wait when StreamRequests has been reached
+
+	// MaxPayloadSize is the largest payload, in bytes, accepted in a single message (0=no limit.)
+	// A request with a larger payload receives an error response, after its payload has been
+	// read and discarded, unless the payload is larger than 16 MiB. Any other message with a
+	// larger payload, and requests with larger payloads than that, cause the connection to be
+	// closed with ProtocolErrorInvalidMsg. In neither case is the payload read into memory.
+	// Operation and notification names are limited to 4095 bytes by the protocol itself.
+	MaxPayloadSize uint32
+
+	// StreamWindow enables flow control of streams when non-zero. It is the number of bytes of
+	// stream data which may be buffered for each incoming stream: the parameters of streaming
+	// requests being handled and the results of streaming requests sent. The sender is told
+	// when it may send more, so that a slow stream doesn't hold up the connection.
+	// Flow control must be supported by the other end, which is the case for Go peers but not
+	// yet for the JavaScript library. Flow control of outgoing streams is always enabled when
+	// the other end uses it.
+	StreamWindow uint32
+
+	// NotificationDispatch controls how notification handlers are called; inline in the
+	// goroutine reading from the socket (the default), concurrently or by a pool of workers.
+	// See NotifyInline, NotifyConcurrent and NotifyWorkerPool.
+	NotificationDispatch NotificationDispatch
+
+	// Notifications is the max number of concurrent notification handlers when
+	// NotificationDispatch is NotifyConcurrent, or the number of workers when it is
+	// NotifyWorkerPool. Not used with NotifyInline.
+	Notifications uint32
+
+	// Shared, if not nil, limits all sockets using it in addition to the limits above.
+	// See SharedLimits.
+	Shared *SharedLimits
+
+	// Adaptive, if not nil, limits the number of concurrent buffer requests of all sockets
+	// using it to a limit which adapts to the latency of handlers. See AdaptiveLimiter.
+	Adaptive *AdaptiveLimiter
+
+	// QueuedRequests is the number of buffer requests which may wait for a free slot when
+	// BufferRequests, or a shared or adaptive limit, has been reached (0=no queue.)
+	// Without a queue, such requests receive a retry response right away and the requestor has
+	// to send the request again, including its payload. Queued requests are handled in the
+	// order they arrive. A request receives a retry response when the queue is full or when it
+	// has waited for QueueWait. See Sock.QueuedRequests and SharedLimits.QueuedRequests.
+	QueuedRequests uint32
+
+	// QueueWait is the longest time a request waits in the queue (defaults to BufferMaxWait)
+	QueueWait time.Duration
 }
 
 // Create new Limits based on DefaultLimits
@@ -72,9 +119,18 @@ func (l *limitCounter) dec() {
 // -----------------------------------------------------------------------------------------------
 
 type limitsImpl struct {
-	readTimeout time.Duration // message reading timeout
-	bufferLimit limitCounter
-	streamLimit limitCounter
+	readTimeout    time.Duration // message reading timeout
+	maxPayloadSize uint32        // 0 means unlimited
+	streamWindow   uint32        // 0 means no flow control
+	notifyDispatch NotificationDispatch
+	notifyLimit    uint32
+	shared         *SharedLimits
+	adaptive       *AdaptiveLimiter
+	queue          *requestQueue // set by Sock.Read when queueSize > 0
+	queueSize      uint32
+	queueWait      time.Duration
+	bufferLimit    limitCounter
+	streamLimit    limitCounter
 
 	bufferMinWait, bufferMaxWait uint32
 	streamMinWait, streamMaxWait uint32
@@ -105,28 +161,94 @@ func makeLimitsImpl(limits *Limits) limitsImpl {
 		streamMaxWait = streamMinWait
 	}
 
+	queueWait := limits.QueueWait
+	if queueWait <= 0 {
+		queueWait = bufferMaxWait
+	}
+
 	return limitsImpl{
-		readTimeout:   limits.ReadTimeout,
-		bufferLimit:   limitCounter{limit: limits.BufferRequests},
-		streamLimit:   limitCounter{limit: limits.StreamRequests},
-		bufferMinWait: uint32(bufferMinWait / time.Millisecond),
-		bufferMaxWait: uint32(bufferMaxWait / time.Millisecond),
-		streamMinWait: uint32(streamMinWait / time.Millisecond),
-		streamMaxWait: uint32(streamMaxWait / time.Millisecond),
+		readTimeout:    limits.ReadTimeout,
+		maxPayloadSize: limits.MaxPayloadSize,
+		streamWindow:   limits.StreamWindow,
+		notifyDispatch: limits.NotificationDispatch,
+		notifyLimit:    limits.Notifications,
+		shared:         limits.Shared,
+		adaptive:       limits.Adaptive,
+		queueSize:      limits.QueuedRequests,
+		queueWait:      queueWait,
+		bufferLimit:    limitCounter{limit: limits.BufferRequests},
+		streamLimit:    limitCounter{limit: limits.StreamRequests},
+		bufferMinWait:  uint32(bufferMinWait / time.Millisecond),
+		bufferMaxWait:  uint32(bufferMaxWait / time.Millisecond),
+		streamMinWait:  uint32(streamMinWait / time.Millisecond),
+		streamMaxWait:  uint32(streamMaxWait / time.Millisecond),
+	}
+}
+
+// limitsStreamWindow returns the effective StreamWindow of limits
+func limitsStreamWindow(limits *Limits) uint32 {
+	if limits == nil {
+		limits = DefaultLimits
+	}
+	return limits.StreamWindow
+}
+
+// Largest oversized request payload which is read and discarded, rather than the connection
+// being closed (see Limits.MaxPayloadSize.) A variable for testing.
+var maxDiscardSize uint32 = 16 * 1024 * 1024
+
+// isPayloadTooLarge returns true if a message of type t with a payload of size bytes
+// exceeds maxPayloadSize
+func (l *limitsImpl) isPayloadTooLarge(t MsgType, size uint32) bool {
+	if l.maxPayloadSize == 0 || size <= l.maxPayloadSize {
+		return false
 	}
+	// heartbeat and protocol error messages use the size field for other purposes
+	return t != MsgTypeHeartbeat && t != MsgTypeProtocolError
 }
 
 func (l *limitsImpl) incBufferReq() bool {
-	if l.bufferLimit.limit == Unlimited {
-		return true
+	if l.bufferLimit.limit != Unlimited && !l.bufferLimit.inc() {
+		return false
+	}
+	if l.shared != nil && !l.shared.incRequest() {
+		if l.bufferLimit.limit != Unlimited {
+			l.bufferLimit.dec()
+		}
+		return false
+	}
+	if l.adaptive != nil && !l.adaptive.acquire() {
+		if l.bufferLimit.limit != Unlimited {
+			l.bufferLimit.dec()
+		}
+		if l.shared != nil {
+			l.shared.decRequest()
+		}
+		return false
 	}
-	return l.bufferLimit.inc()
+	return true
 }
 
 func (l *limitsImpl) decBufferReq() {
 	if l.bufferLimit.limit != Unlimited {
 		l.bufferLimit.dec()
 	}
+	if l.shared != nil {
+		l.shared.decRequest()
+	}
+	if l.adaptive != nil {
+		l.adaptive.release()
+	}
+	if l.queue != nil {
+		l.queue.signal()
+	}
+}
+
+// observeBufferReq is called with the time it took to handle a buffer request
+func (l *limitsImpl) observeBufferReq(latency time.Duration) {
+	if l.adaptive != nil {
+		l.adaptive.observe(latency)
+	}
 }
 
 func (l *limitsImpl) streamReqEnabled() bool {
@@ -134,20 +256,32 @@ func (l *limitsImpl) streamReqEnabled() bool {
 }
 
 func (l *limitsImpl) incStreamReq() bool {
-	if l.streamLimit.limit == Unlimited {
-		return true
+	if l.streamLimit.limit != Unlimited && !l.streamLimit.inc() {
+		return false
 	}
-	return l.streamLimit.inc()
+	if l.shared != nil && !l.shared.incRequest() {
+		if l.streamLimit.limit != Unlimited {
+			l.streamLimit.dec()
+		}
+		return false
+	}
+	return true
 }
 
 func (l *limitsImpl) decStreamReq() {
 	if l.streamLimit.limit != Unlimited {
 		l.streamLimit.dec()
 	}
+	if l.shared != nil {
+		l.shared.decRequest()
+	}
 }
 
 func (l *limitsImpl) waitBufferReq() uint32 {
 	// Time to tell requestor to wait when sending a buffer requests while limit has been reached
+	if l.adaptive != nil {
+		return l.adaptive.waitHint(l.bufferMinWait, l.bufferMaxWait)
+	}
 	return randUint32(l.bufferMinWait, l.bufferMaxWait)
 }
 
@@ -1,6 +1,9 @@
 package gotalk
 
 import (
+	"context"
+	"io"
+	"net"
 	"testing"
 	"time"
 )
@@ -71,4 +74,66 @@ func TestLimits(t *testing.T) {
 	assertEq(t, l.bufferLimit.count, uint32(0))
 	assertEq(t, l.streamLimit.count, uint32(0))
 
+	// payload size
+	l = makeLimitsImpl(NoLimits)
+	assertEq(t, l.isPayloadTooLarge(MsgTypeSingleReq, 0xFFFFFFFF), false)
+	l = makeLimitsImpl(&Limits{MaxPayloadSize: 10})
+	assertEq(t, l.isPayloadTooLarge(MsgTypeSingleReq, 10), false)
+	assertEq(t, l.isPayloadTooLarge(MsgTypeSingleReq, 11), true)
+	assertEq(t, l.isPayloadTooLarge(MsgTypeNotification, 11), true)
+	assertEq(t, l.isPayloadTooLarge(MsgTypeHeartbeat, 11), false)
+	assertEq(t, l.isPayloadTooLarge(MsgTypeProtocolError, 11), false)
+
+	// shared limits apply across sockets
+	shared := &SharedLimits{Requests: 2}
+	limits := &Limits{BufferRequests: Unlimited, StreamRequests: 1, Shared: shared}
+	l1, l2 := makeLimitsImpl(limits), makeLimitsImpl(limits)
+	assertEq(t, l1.incBufferReq(), true)
+	assertEq(t, l2.incStreamReq(), true)
+	assertEq(t, l1.incBufferReq(), false)
+	assertEq(t, l1.incStreamReq(), false)
+	assertEq(t, shared.ActiveRequests(), 2)
+	l2.decStreamReq()
+	assertEq(t, l2.streamLimit.count, uint32(0))
+	assertEq(t, l1.incStreamReq(), true)
+	assertEq(t, l1.streamLimit.count, uint32(1))
+	l1.decBufferReq()
+	l1.decStreamReq()
+	assertEq(t, shared.ActiveRequests(), 0)
+}
+
+func TestSharedLimitsConnections(t *testing.T) {
+	l := &SharedLimits{Connections: 3, ConnectionsPerIP: 2}
+	assertEq(t, l.addConn("1.1.1.1"), true)
+	assertEq(t, l.addConn("1.1.1.1"), true)
+	assertEq(t, l.addConn("1.1.1.1"), false)
+	assertEq(t, l.addConn("2.2.2.2"), true)
+	assertEq(t, l.addConn("3.3.3.3"), false)
+	assertEq(t, l.ActiveConnections(), 3)
+	l.removeConn("1.1.1.1")
+	assertEq(t, l.addConn("3.3.3.3"), true)
+	assertEq(t, l.addConn("3.3.3.3"), false)
+}
+
+func TestSharedLimitsStreamReqDisconnect(t *testing.T) {
+	// a requestor which disconnects in the middle of a stream request part
+	h := &Handlers{}
+	h.HandleStreamRequestContext("upload", func(
+		ctx context.Context, s *Sock, op string, rch chan []byte, out io.WriteCloser) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	shared := &SharedLimits{Requests: 2}
+	c1, c2 := net.Pipe()
+	s := NewSock(h)
+	s.Adopt(c2)
+	go s.Read(&Limits{StreamRequests: Unlimited, Shared: shared})
+
+	c1.Write(append(MakeMsg(MsgTypeStreamReq, "0001", "upload", 0, 1), 'a'))
+	waitFor(t, "request to start", func() bool { return shared.ActiveRequests() == 1 })
+	c1.Write(append(MakeMsg(MsgTypeStreamReqPart, "0001", "", 0, 10), "abc"...))
+	c1.Close()
+	waitFor(t, "socket to close", s.IsClosed)
+	s.handlerWg.Wait()
+	assertEq(t, 0, shared.ActiveRequests())
 }
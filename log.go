@@ -12,6 +12,9 @@ var (
 
 	// HandlerErrorLogger is called when a handler function either panics or returns an error
 	HandlerErrorLogger LoggerFunc = DefaultLoggerFunc
+
+	// AccessDeniedLogger is called when a request is denied by the AccessPolicy of its handlers
+	AccessDeniedLogger LoggerFunc = DefaultLoggerFunc
 )
 
 // DefaultLoggerFunc forwards the message to Go's "log" package; log.Printf(format, args...)
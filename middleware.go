@@ -0,0 +1,242 @@
+package gotalk
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// BufferReqMiddleware wraps a buffer request handler, returning a handler which typically does
+// something before and/or after calling next. See Handlers.Use.
+type BufferReqMiddleware func(next BufferReqContextHandler) BufferReqContextHandler
+
+// StreamReqMiddleware wraps a stream request handler. See Handlers.Use.
+type StreamReqMiddleware func(next StreamReqContextHandler) StreamReqContextHandler
+
+// NoteMiddleware wraps a notification handler. See Handlers.Use.
+type NoteMiddleware func(next BufferNoteHandler) BufferNoteHandler
+
+// Use adds middleware which wraps handlers for cross-cutting concerns like authorization,
+// logging or metrics. Each middleware must be one of BufferReqMiddleware, StreamReqMiddleware
+// or NoteMiddleware, or a function with the same signature. Use panics if it is not.
+//
+// Middleware applies to all handlers found through h, including handlers registered before
+// the call to Use and handlers of outer Handlers. Sub-handlers created with NewSubHandlers
+// inherit the middleware of h.
+//
+// Middleware runs in the order it was added, with middleware of outer handlers running before
+// that of sub-handlers. For example:
+//
+//   h.Use(func(next gotalk.BufferReqContextHandler) gotalk.BufferReqContextHandler {
+//     return func(ctx context.Context, s *gotalk.Sock, op string, b []byte) ([]byte, error) {
+//       start := time.Now()
+//       result, err := next(ctx, s, op, b)
+//       log.Printf("%s took %s (error: %v)", op, time.Since(start), err)
+//       return result, err
+//     }
+//   })
+//
+func (h *Handlers) Use(middleware ...interface{}) {
+	h.middlewareMu.Lock()
+	defer h.middlewareMu.Unlock()
+	defer h.changed()
+	for _, mw := range middleware {
+		switch mw := mw.(type) {
+		case BufferReqMiddleware:
+			h.bufReqMiddleware = append(h.bufReqMiddleware, mw)
+		case func(BufferReqContextHandler) BufferReqContextHandler:
+			h.bufReqMiddleware = append(h.bufReqMiddleware, mw)
+		case StreamReqMiddleware:
+			h.streamReqMiddleware = append(h.streamReqMiddleware, mw)
+		case func(StreamReqContextHandler) StreamReqContextHandler:
+			h.streamReqMiddleware = append(h.streamReqMiddleware, mw)
+		case NoteMiddleware:
+			h.noteMiddleware = append(h.noteMiddleware, mw)
+		case func(BufferNoteHandler) BufferNoteHandler:
+			h.noteMiddleware = append(h.noteMiddleware, mw)
+		default:
+			panic("invalid middleware type (see https://pkg.go.dev/github.com/rsms/gotalk#Handlers.Use)")
+		}
+	}
+}
+
+// The wrap functions apply middleware from the innermost handlers outwards, last added first,
+// so that the middleware of the outermost handlers which was added first ends up running first.
+
+func (h *Handlers) wrapBufferRequestHandler(fn BufferReqContextHandler) BufferReqContextHandler {
+	for ; h != nil; h = h.outer {
+		h.middlewareMu.RLock()
+		for i := len(h.bufReqMiddleware) - 1; i >= 0; i-- {
+			fn = h.bufReqMiddleware[i](fn)
+		}
+		h.middlewareMu.RUnlock()
+	}
+	return fn
+}
+
+func (h *Handlers) wrapStreamRequestHandler(fn StreamReqContextHandler) StreamReqContextHandler {
+	for ; h != nil; h = h.outer {
+		h.middlewareMu.RLock()
+		for i := len(h.streamReqMiddleware) - 1; i >= 0; i-- {
+			fn = h.streamReqMiddleware[i](fn)
+		}
+		h.middlewareMu.RUnlock()
+	}
+	return fn
+}
+
+func (h *Handlers) wrapNotificationHandler(fn BufferNoteHandler) BufferNoteHandler {
+	for ; h != nil; h = h.outer {
+		h.middlewareMu.RLock()
+		for i := len(h.noteMiddleware) - 1; i >= 0; i-- {
+			fn = h.noteMiddleware[i](fn)
+		}
+		h.middlewareMu.RUnlock()
+	}
+	return fn
+}
+
+// -------------------------------------------------------------------------------------
+
+// Max number of wrapped handlers cached per Handlers. Requests for arbitrary operations which
+// end up at a fallback handler would otherwise grow the cache without bound.
+const maxWrappedHandlers = 1024
+
+// wrappedHandlers caches handlers wrapped in middleware, so that middleware is not applied
+// anew each time a handler is looked up. It is valid as long as gen matches the generation of
+// the Handlers (see Handlers.generation.)
+type wrappedHandlers struct {
+	mu        sync.RWMutex
+	gen       uint32
+	bufReq    map[string]BufferReqContextHandler
+	streamReq map[string]StreamReqContextHandler
+	note      map[string]BufferNoteHandler
+	noteHdr   map[string]BufferNoteHandler // handlers of HandleBufferNotificationHeader
+}
+
+// changed invalidates wrapped handlers cached by h and its sub-handlers
+func (h *Handlers) changed() {
+	atomic.AddUint32(&h.gen, 1)
+}
+
+// generation returns a number which changes when handlers or middleware of h or any of its
+// outer handlers change
+func (h *Handlers) generation() (gen uint32) {
+	for ; h != nil; h = h.outer {
+		gen += atomic.LoadUint32(&h.gen)
+	}
+	return
+}
+
+// lookup calls fn with the cache locked for reading if it is valid for generation gen
+func (w *wrappedHandlers) lookup(gen uint32, fn func()) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.gen == gen {
+		fn()
+	}
+}
+
+// store calls fn with the cache locked for writing, after clearing it if it was built for an
+// earlier generation than gen. fn is not called if the cache is newer than gen.
+func (w *wrappedHandlers) store(gen uint32, fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.gen != gen {
+		if int32(gen-w.gen) < 0 {
+			return
+		}
+		w.gen = gen
+		w.bufReq, w.streamReq, w.note, w.noteHdr = nil, nil, nil, nil
+	}
+	fn()
+}
+
+func (h *Handlers) findWrappedBufferRequestHandler(op string) (fn BufferReqContextHandler) {
+	gen := h.generation()
+	h.wrapped.lookup(gen, func() { fn = h.wrapped.bufReq[op] })
+	if fn != nil {
+		return fn
+	}
+	if fn = h.findBufferRequestHandler(op); fn == nil {
+		return nil
+	}
+	fn = h.wrapBufferRequestHandler(fn)
+	h.wrapped.store(gen, func() {
+		if h.wrapped.bufReq == nil {
+			h.wrapped.bufReq = make(map[string]BufferReqContextHandler)
+		}
+		if len(h.wrapped.bufReq) < maxWrappedHandlers {
+			h.wrapped.bufReq[op] = fn
+		}
+	})
+	return fn
+}
+
+func (h *Handlers) findWrappedStreamRequestHandler(op string) (fn StreamReqContextHandler) {
+	gen := h.generation()
+	h.wrapped.lookup(gen, func() { fn = h.wrapped.streamReq[op] })
+	if fn != nil {
+		return fn
+	}
+	if fn = h.findStreamRequestHandler(op); fn == nil {
+		return nil
+	}
+	fn = h.wrapStreamRequestHandler(fn)
+	h.wrapped.store(gen, func() {
+		if h.wrapped.streamReq == nil {
+			h.wrapped.streamReq = make(map[string]StreamReqContextHandler)
+		}
+		if len(h.wrapped.streamReq) < maxWrappedHandlers {
+			h.wrapped.streamReq[op] = fn
+		}
+	})
+	return fn
+}
+
+func (h *Handlers) findWrappedNotificationHandler(name string) (fn BufferNoteHandler) {
+	gen := h.generation()
+	h.wrapped.lookup(gen, func() { fn = h.wrapped.note[name] })
+	if fn != nil {
+		return fn
+	}
+	if fn = h.findNotificationHandler(name); fn == nil {
+		return nil
+	}
+	fn = h.wrapNotificationHandler(fn)
+	h.wrapped.store(gen, func() {
+		if h.wrapped.note == nil {
+			h.wrapped.note = make(map[string]BufferNoteHandler)
+		}
+		if len(h.wrapped.note) < maxWrappedHandlers {
+			h.wrapped.note[name] = fn
+		}
+	})
+	return fn
+}
+
+// findWrappedNotificationHeaderHandler is like findWrappedNotificationHandler but returns the
+// handler registered with HandleBufferNotificationHeader, if any. The returned handler reads
+// the header of the notification with Sock.noteHeader.
+func (h *Handlers) findWrappedNotificationHeaderHandler(name string) (fn BufferNoteHandler) {
+	gen := h.generation()
+	h.wrapped.lookup(gen, func() { fn = h.wrapped.noteHdr[name] })
+	if fn != nil {
+		return fn
+	}
+	headerFn := h.findNotificationHeaderHandler(name)
+	if headerFn == nil {
+		return nil
+	}
+	fn = h.wrapNotificationHandler(func(s *Sock, name string, payload []byte) {
+		headerFn(s, name, s.noteHeader(payload), payload)
+	})
+	h.wrapped.store(gen, func() {
+		if h.wrapped.noteHdr == nil {
+			h.wrapped.noteHdr = make(map[string]BufferNoteHandler)
+		}
+		if len(h.wrapped.noteHdr) < maxWrappedHandlers {
+			h.wrapped.noteHdr[name] = fn
+		}
+	})
+	return fn
+}
@@ -0,0 +1,115 @@
+package gotalk
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	var trace []string
+	tracer := func(name string) BufferReqMiddleware {
+		return func(next BufferReqContextHandler) BufferReqContextHandler {
+			return func(ctx context.Context, s *Sock, op string, b []byte) ([]byte, error) {
+				trace = append(trace, name+" "+op)
+				return next(ctx, s, op, b)
+			}
+		}
+	}
+
+	h := &Handlers{}
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		trace = append(trace, "handler")
+		return b, nil
+	})
+	h.Use(tracer("a"), tracer("b"))
+	sub := h.NewSubHandlers()
+	sub.Use(func(next BufferReqContextHandler) BufferReqContextHandler { // unnamed type
+		return tracer("c")(next)
+	})
+
+	b, err := sub.FindBufferRequestHandler("echo")(nil, "echo", []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytes(t, []byte("hi"), b)
+	assertEq(t, "a echo,b echo,c echo,handler", strings.Join(trace, ","))
+
+	// outer handlers are not affected by middleware of sub-handlers
+	trace = nil
+	h.FindBufferRequestHandler("echo")(nil, "echo", nil)
+	assertEq(t, "a echo,b echo,handler", strings.Join(trace, ","))
+
+	// unknown operations are not wrapped
+	assertEq(t, true, sub.FindBufferRequestHandler("nope") == nil)
+
+	// stream requests
+	trace = nil
+	h.HandleStreamRequest("stream", func(s *Sock, op string, rch chan []byte, out io.WriteCloser) error {
+		trace = append(trace, "handler")
+		return nil
+	})
+	sub.Use(StreamReqMiddleware(func(next StreamReqContextHandler) StreamReqContextHandler {
+		return func(ctx context.Context, s *Sock, op string, rch chan []byte, out io.WriteCloser) error {
+			trace = append(trace, "stream "+op)
+			return next(ctx, s, op, rch, out)
+		}
+	}))
+	sub.FindStreamRequestHandler("stream")(nil, "stream", nil, nil)
+	assertEq(t, "stream stream,handler", strings.Join(trace, ","))
+
+	// notifications
+	trace = nil
+	h.HandleBufferNotification("note", func(s *Sock, name string, b []byte) {
+		trace = append(trace, "handler")
+	})
+	sub.Use(func(next BufferNoteHandler) BufferNoteHandler {
+		return func(s *Sock, name string, b []byte) {
+			trace = append(trace, "note "+name)
+			next(s, name, b)
+		}
+	})
+	sub.FindNotificationHandler("note")(nil, "note", nil)
+	assertEq(t, "note note,handler", strings.Join(trace, ","))
+
+	assertPanic(t, "invalid middleware", func() {
+		h.Use(func() {})
+	})
+}
+
+func TestMiddlewareCache(t *testing.T) {
+	wraps := 0
+	mw := func(next BufferReqContextHandler) BufferReqContextHandler {
+		wraps++
+		return next
+	}
+	echo := func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	}
+
+	h := &Handlers{}
+	h.HandleBufferRequest("echo", echo)
+	h.Use(mw)
+	sub := h.NewSubHandlers()
+
+	// middleware is applied once, not on every lookup
+	sub.FindBufferRequestContextHandler("echo")
+	sub.FindBufferRequestContextHandler("echo")
+	assertEq(t, 1, wraps)
+
+	// changes to outer handlers invalidate the cache of sub-handlers
+	h.HandleBufferRequest("echo", echo)
+	sub.FindBufferRequestContextHandler("echo")
+	sub.FindBufferRequestContextHandler("echo")
+	assertEq(t, 2, wraps)
+
+	h.Use(mw)
+	sub.FindBufferRequestContextHandler("echo")
+	assertEq(t, 4, wraps)
+
+	// unknown operations are not cached
+	assertEq(t, true, sub.FindBufferRequestContextHandler("nope") == nil)
+	h.HandleBufferRequest("nope", echo)
+	assertEq(t, true, sub.FindBufferRequestContextHandler("nope") != nil)
+}
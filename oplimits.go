@@ -0,0 +1,213 @@
+package gotalk
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// OpLimits limits requests for a certain operation. See Handlers.SetOpLimits.
+// Requests which exceed a limit receive a retry response telling the requestor how long to
+// wait before trying again.
+type OpLimits struct {
+	MaxConcurrent        uint32 // max concurrent requests across all sockets (0=no limit)
+	MaxConcurrentPerSock uint32 // max concurrent requests per socket (0=no limit)
+
+	// Rate is the number of requests per second allowed per socket (0=no limit.)
+	// Burst is the number of requests which can be made at once after a period of inactivity.
+	// It defaults to Rate, rounded up, or 1 if Rate is less than 1.
+	Rate  float64
+	Burst uint32
+
+	// GlobalRate and GlobalBurst are like Rate and Burst but apply to all sockets together
+	GlobalRate  float64
+	GlobalBurst uint32
+
+	// Bounds of the time a requestor is told to wait when a limit has been exceeded.
+	// When a concurrency limit is exceeded, a random wait between MinWait and MaxWait is used.
+	// When a rate limit is exceeded, the wait is the time until the next request is allowed,
+	// clamped to MinWait and MaxWait if they are set.
+	// Default to Limits.BufferMinWait and BufferMaxWait (or StreamMinWait and StreamMaxWait.)
+	MinWait time.Duration
+	MaxWait time.Duration
+}
+
+// SetOpLimits sets limits for requests of operation `op`, replacing any limits set earlier.
+// Passing nil removes any limits. The limits apply in addition to the Limits of each socket.
+func (h *Handlers) SetOpLimits(op string, limits *OpLimits) {
+	if len(op) == 0 {
+		panic("SetOpLimits: empty op")
+	}
+	h.opLimitsMu.Lock()
+	defer h.opLimitsMu.Unlock()
+	if limits == nil {
+		delete(h.opLimits, op)
+		return
+	}
+	if h.opLimits == nil {
+		h.opLimits = make(map[string]*opLimiter)
+	}
+	h.opLimits[op] = newOpLimiter(*limits)
+}
+
+func (h *Handlers) findOpLimiter(op string) *opLimiter {
+	h.opLimitsMu.RLock()
+	defer h.opLimitsMu.RUnlock()
+	if l, ok := h.opLimits[op]; ok {
+		return l
+	}
+	if h.outer != nil {
+		return h.outer.findOpLimiter(op)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// tokenBucket implements a token bucket rate limiter
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // capacity
+	tokens float64
+	last   time.Time
+}
+
+func makeTokenBucket(rate float64, burst uint32) tokenBucket {
+	b := float64(burst)
+	if b == 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+// check refills the bucket and returns 0 if a token is available or else how long it will take
+// until one is
+func (b *tokenBucket) check(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take() {
+	if b.rate > 0 {
+		b.tokens--
+	}
+}
+
+// opLimiter holds the state of an operation's OpLimits which is shared by all sockets
+type opLimiter struct {
+	OpLimits
+	mu     sync.Mutex
+	active uint32
+	bucket tokenBucket
+}
+
+// sockOpLimiter holds the state of an operation's OpLimits for one socket
+type sockOpLimiter struct {
+	op     string
+	active uint32
+	bucket tokenBucket
+}
+
+func newOpLimiter(limits OpLimits) *opLimiter {
+	return &opLimiter{OpLimits: limits, bucket: makeTokenBucket(limits.GlobalRate, limits.GlobalBurst)}
+}
+
+// wait returns how long to tell a requestor to wait. d is the time until the request would be
+// allowed, or 0 if unknown.
+func (l *opLimiter) wait(d time.Duration, defaultMin, defaultMax uint32) uint32 {
+	min, max := defaultMin, defaultMax
+	if l.MinWait > 0 {
+		min = uint32(l.MinWait / time.Millisecond)
+	}
+	if l.MaxWait > 0 {
+		max = uint32(l.MaxWait / time.Millisecond)
+	}
+	if max < min {
+		max = min
+	}
+	if d == 0 {
+		if max == min {
+			return min
+		}
+		return randUint32(min, max)
+	}
+	ms := uint32((d + time.Millisecond - 1) / time.Millisecond)
+	if l.MinWait > 0 && ms < min {
+		ms = min
+	}
+	if l.MaxWait > 0 && ms > max {
+		ms = max
+	}
+	return ms
+}
+
+// acquireOp checks the OpLimits of op, if any, for a new request. If a limit has been exceeded
+// refused describes the limit and wait is how long, in milliseconds, the requestor should wait.
+// Otherwise refused is empty and release must be called when the request is done.
+func (s *Sock) acquireOp(op string, minWait, maxWait uint32) (
+	release func(), wait uint32, refused string,
+) {
+	l := s.Handlers.findOpLimiter(op)
+	if l == nil {
+		return func() {}, 0, ""
+	}
+
+	s.opLimitersMu.Lock()
+	defer s.opLimitersMu.Unlock()
+	sl := s.opLimiters[l]
+	if sl == nil {
+		s.pruneOpLimiters()
+		sl = &sockOpLimiter{op: op, bucket: makeTokenBucket(l.Rate, l.Burst)}
+		if s.opLimiters == nil {
+			s.opLimiters = make(map[*opLimiter]*sockOpLimiter)
+		}
+		s.opLimiters[l] = sl
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if (l.MaxConcurrentPerSock != 0 && sl.active >= l.MaxConcurrentPerSock) ||
+		(l.MaxConcurrent != 0 && l.active >= l.MaxConcurrent) {
+		return nil, l.wait(0, minWait, maxWait), "operation concurrency limit"
+	}
+	now := time.Now()
+	d := sl.bucket.check(now)
+	if d2 := l.bucket.check(now); d2 > d {
+		d = d2
+	}
+	if d > 0 {
+		return nil, l.wait(d, minWait, maxWait), "operation rate limit"
+	}
+	sl.bucket.take()
+	l.bucket.take()
+	sl.active++
+	l.active++
+
+	return func() {
+		s.opLimitersMu.Lock()
+		sl.active--
+		s.opLimitersMu.Unlock()
+		l.mu.Lock()
+		l.active--
+		l.mu.Unlock()
+	}, 0, ""
+}
+
+// pruneOpLimiters forgets the state of OpLimits which have been replaced or removed (see
+// Handlers.SetOpLimits) and have no active requests. Must be called with opLimitersMu held.
+func (s *Sock) pruneOpLimiters() {
+	for l, sl := range s.opLimiters {
+		if sl.active == 0 && s.Handlers.findOpLimiter(sl.op) != l {
+			delete(s.opLimiters, l)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package gotalk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := makeTokenBucket(10, 2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		assertEq(t, time.Duration(0), b.check(now))
+		b.take()
+	}
+	assertEq(t, 100*time.Millisecond, b.check(now))
+	assertEq(t, 50*time.Millisecond, b.check(now.Add(50*time.Millisecond)))
+	assertEq(t, time.Duration(0), b.check(now.Add(100*time.Millisecond)))
+
+	// burst defaults to rate
+	b = makeTokenBucket(2.5, 0)
+	assertEq(t, float64(3), b.burst)
+	b = makeTokenBucket(0.5, 0)
+	assertEq(t, float64(1), b.burst)
+
+	// no rate means no limit
+	b = makeTokenBucket(0, 0)
+	b.take()
+	b.take()
+	assertEq(t, time.Duration(0), b.check(now))
+}
+
+func TestOpLimits(t *testing.T) {
+	h := &Handlers{}
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	h.HandleBufferRequest("export", func(s *Sock, op string, b []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-release
+		return b, nil
+	})
+	h.HandleBufferRequest("ping", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+	h.SetOpLimits("export", &OpLimits{
+		MaxConcurrent: 1,
+		MinWait:       50 * time.Millisecond,
+		MaxWait:       50 * time.Millisecond,
+	})
+	sub := h.NewSubHandlers()
+	sub.SetOpLimits("ping", &OpLimits{Rate: 1, Burst: 2, MaxWait: 800 * time.Millisecond})
+
+	s1, s2, err := Pipe(sub, &Limits{BufferRequests: Unlimited})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	send := func(op string) Response {
+		t.Helper()
+		reschan := make(chan Response, 1)
+		if err := s1.SendRequest(NewRequest(op, []byte("x")), reschan); err != nil {
+			t.Fatal(err)
+		}
+		return <-reschan
+	}
+
+	// concurrency limit (set on outer handlers)
+	s1.SendRequest(NewRequest("export", nil), make(chan Response, 1))
+	<-started
+	res := send("export")
+	assertEq(t, true, res.IsRetry())
+	assertEq(t, 50*time.Millisecond, res.Wait)
+	assertEq(t, "operation concurrency limit", string(res.Data))
+
+	// other operations are not affected by the concurrency limit
+	assertEq(t, MsgTypeSingleRes, send("ping").MsgType)
+	close(release)
+
+	// rate limit
+	assertEq(t, MsgTypeSingleRes, send("ping").MsgType) // burst
+	res = send("ping")
+	assertEq(t, true, res.IsRetry())
+	assertEq(t, 800*time.Millisecond, res.Wait) // clamped to MaxWait
+	assertEq(t, "operation rate limit", string(res.Data))
+
+	// state of replaced limits is forgotten
+	for i := 0; i < 3; i++ {
+		sub.SetOpLimits("ping", &OpLimits{Rate: 1000})
+		assertEq(t, MsgTypeSingleRes, send("ping").MsgType)
+	}
+	s2.opLimitersMu.Lock()
+	n := len(s2.opLimiters)
+	s2.opLimitersMu.Unlock()
+	assertEq(t, 2, n) // export and ping
+}
@@ -24,14 +24,28 @@ const (
 	MsgTypeNotification  = MsgType('n')
 	MsgTypeHeartbeat     = MsgType('h')
 	MsgTypeProtocolError = MsgType('f')
+	MsgTypeCancelReq     = MsgType('c')
+
+	// Flow control (see Limits.StreamWindow)
+	MsgTypeStreamReqWindow = MsgType('w') // sent by responder; more credit for StreamReqPart
+	MsgTypeStreamResWindow = MsgType('W') // sent by requestor; more credit for StreamRes
+
+	// Sent by requestor right before a request; wait is the request's timeout in milliseconds.
+	// Only sent to peers which support it. See Sock.BufferRequestContext.
+	MsgTypeReqDeadline = MsgType('d')
+
+	// Sent right before a request, result or notification; the payload is its header.
+	// Only sent to peers which support it. See Header.
+	MsgTypeHeader = MsgType('H')
 )
 
 // ProtocolError codes
 const (
-	ProtocolErrorAbnormal    = 0
-	ProtocolErrorUnsupported = 1
-	ProtocolErrorInvalidMsg  = 2
-	ProtocolErrorTimeout     = 3
+	ProtocolErrorAbnormal     = 0
+	ProtocolErrorUnsupported  = 1
+	ProtocolErrorInvalidMsg   = 2
+	ProtocolErrorTimeout      = 3
+	ProtocolErrorUnauthorized = 4 // authentication failed (see Authenticator)
 )
 
 // Protocol message type
@@ -79,7 +93,7 @@ func MakeMsg(t MsgType, id, name3 string, wait, size uint32) []byte {
 	bz := 9 // minimum size, fitting type and payload size
 	name3z := 0
 
-	if t == MsgTypeRetryRes {
+	if hasWaitField(t) {
 		bz = 21 // e.g. "e00010000000100000001"
 	} else {
 		if id != "" {
@@ -110,7 +124,7 @@ func MakeMsg(t MsgType, id, name3 string, wait, size uint32) []byte {
 		z += name3z
 	}
 
-	if t == MsgTypeRetryRes {
+	if hasWaitField(t) {
 		copyFixnum(b[z:z+8], 8, uint64(wait), 16)
 		z += 8
 	}
@@ -130,6 +144,7 @@ func ReadMsg(s io.Reader, b []byte) (t MsgType, id, name3 string, wait, size uin
 	// "r0001004echo00000005"  => ('r', "0001", "echo", 0, 5, nil)
 	// "R000100000005"         => ('R', "0001", "", 0, 5, nil)
 	// "e00010000138800000014" => ('e', "0001", "", 5000, 20, nil)
+	// "w00010001000000000000" => ('w', "0001", "", 65536, 0, nil)
 
 	// A message has a minimum size of 13, so read first 13 bytes
 	// e.g. "n001a00000000" = <notification> <short name> <no payload>
@@ -194,8 +209,8 @@ func ReadMsg(s io.Reader, b []byte) (t MsgType, id, name3 string, wait, size uin
 		name3 = string(b[z : z+int(name3z)])
 		z += int(name3z)
 
-	} else if t == MsgTypeRetryRes {
-		// wait
+	} else if hasWaitField(t) {
+		// wait (or window increment)
 		n, e := strconv.ParseUint(string(b[z:z+8]), 16, 32)
 		if e != nil {
 			err = e
@@ -220,6 +235,13 @@ func ReadMsg(s io.Reader, b []byte) (t MsgType, id, name3 string, wait, size uin
 	return
 }
 
+// hasWaitField returns true for message types which have a "wait" field.
+// Window updates use it for the window increment and deadlines for the timeout.
+func hasWaitField(t MsgType) bool {
+	return t == MsgTypeRetryRes || t == MsgTypeStreamReqWindow || t == MsgTypeStreamResWindow ||
+		t == MsgTypeReqDeadline
+}
+
 // Returns a 4-byte representation of a 32-bit integer, suitable an integer-based request ID.
 func FormatRequestID(n uint32) []byte {
 	buf := bytes.NewBuffer(make([]byte, 4)[:0])
@@ -65,6 +65,9 @@ func init() {
 		{MsgTypeRetryRes, "idid", "", 6, 3, []byte("eidid0000000600000003")},
 		{MsgTypeRetryRes, "idid", "", 0, 3, []byte("eidid0000000000000003")},
 		{MsgTypeNotification, "", "hello", 0, 3, []byte("n005hello00000003")},
+		{MsgTypeCancelReq, "idid", "", 0, 0, []byte("cidid00000000")},
+		{MsgTypeStreamReqWindow, "idid", "", 0x400, 0, []byte("widid0000040000000000")},
+		{MsgTypeStreamResWindow, "idid", "", 0x400, 0, []byte("Widid0000040000000000")},
 		// {MsgTypeHeartbeat, "", "", 2, 0x5f63ee48, []byte("h00025f63ee48")}, MakeMsg can't handle it
 	}
 }
@@ -133,6 +136,11 @@ func TestWriteMsg(t *testing.T) {
 		{MsgTypeErrorRes, "abcd", "", 0, 8, []byte{}},
 		{MsgTypeRetryRes, "abcd", "", 6, 8, []byte{}},
 		{MsgTypeNotification, "", "hello", 0, 9, []byte{}},
+		{MsgTypeCancelReq, "abcd", "", 0, 0, []byte{}},
+		{MsgTypeStreamReqWindow, "abcd", "", 1024, 0, []byte{}},
+		{MsgTypeStreamResWindow, "abcd", "", 1024, 0, []byte{}},
+		{MsgTypeReqDeadline, "abcd", "", 5000, 0, []byte{}},
+		{MsgTypeHeader, "abcd", "", 0, 20, []byte("005trace0000000412ab")},
 		{MsgTypeProtocolError, "", "", 0, ProtocolErrorInvalidMsg, []byte{}},
 	}
 
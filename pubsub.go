@@ -0,0 +1,162 @@
+package gotalk
+
+import (
+	"sync"
+)
+
+// Names of the operations registered by NewPubSub
+const (
+	PubSubSubscribeOp   = "subscribe"
+	PubSubUnsubscribeOp = "unsubscribe"
+)
+
+// PubSub implements topic-based publish/subscribe on top of notifications.
+// Sockets subscribe to topics and any value published to a topic is sent as a notification,
+// named by the topic, to all sockets subscribed to that topic.
+// Sockets are automatically unsubscribed from all topics when they close.
+type PubSub struct {
+	// Authorize is called when a peer asks to subscribe to a topic, after the "subscribe"
+	// operation itself has passed access control (see Handlers.SetOpAccess). If it returns an
+	// error, the subscription is denied like any other request: the error is logged with
+	// AccessDeniedLogger and the peer receives ErrAccessDenied.
+	// If Authorize is nil, all subscriptions are allowed.
+	// Not called for subscriptions made with Subscribe.
+	Authorize func(s *Sock, topic string) error
+
+	mu     sync.RWMutex
+	topics map[string]map[*Sock]struct{} // subscribers by topic
+	socks  map[*Sock]map[string]struct{} // topics by subscriber
+}
+
+// NewPubSub creates a PubSub and registers the "subscribe" and "unsubscribe" operations with
+// h, allowing peers to manage their own subscriptions. Both operations take a topic string.
+// If h is nil, DefaultHandlers is used.
+func NewPubSub(h *Handlers) *PubSub {
+	if h == nil {
+		h = DefaultHandlers
+	}
+	p := &PubSub{}
+	h.Handle(PubSubSubscribeOp, func(s *Sock, topic string) error {
+		if p.Authorize != nil {
+			if err := p.Authorize(s, topic); err != nil {
+				AccessDeniedLogger(s, "access denied: %v (topic %q)", err, topic)
+				return ErrAccessDenied
+			}
+		}
+		p.Subscribe(s, topic)
+		return nil
+	})
+	h.Handle(PubSubUnsubscribeOp, func(s *Sock, topic string) error {
+		p.Unsubscribe(s, topic)
+		return nil
+	})
+	return p
+}
+
+// Subscribe s to topic. Subscribing to a topic which s is already subscribed to has no effect.
+func (p *PubSub) Subscribe(s *Sock, topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.topics == nil {
+		p.topics = make(map[string]map[*Sock]struct{})
+		p.socks = make(map[*Sock]map[string]struct{})
+	}
+	subs := p.topics[topic]
+	if subs == nil {
+		subs = make(map[*Sock]struct{})
+		p.topics[topic] = subs
+	}
+	subs[s] = struct{}{}
+	topics := p.socks[s]
+	if topics == nil {
+		topics = make(map[string]struct{})
+		p.socks[s] = topics
+		s.setCloseHook(p, p.UnsubscribeAll)
+	}
+	topics[topic] = struct{}{}
+	if s.IsClosed() {
+		// s closed before the close hook was registered
+		p.unsubscribeAll(s)
+	}
+}
+
+// Unsubscribe s from topic
+func (p *PubSub) Unsubscribe(s *Sock, topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	topics := p.socks[s]
+	if topics == nil {
+		return
+	}
+	delete(topics, topic)
+	if len(topics) == 0 {
+		delete(p.socks, s)
+		s.setCloseHook(p, nil)
+	}
+	p.removeSubscriber(topic, s)
+}
+
+// UnsubscribeAll unsubscribes s from all topics
+func (p *PubSub) UnsubscribeAll(s *Sock) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unsubscribeAll(s)
+}
+
+func (p *PubSub) unsubscribeAll(s *Sock) {
+	topics := p.socks[s]
+	if topics == nil {
+		return
+	}
+	delete(p.socks, s)
+	s.setCloseHook(p, nil)
+	for topic := range topics {
+		p.removeSubscriber(topic, s)
+	}
+}
+
+// removeSubscriber removes s from the subscribers of topic. p.mu must be locked.
+func (p *PubSub) removeSubscriber(topic string, s *Sock) {
+	if subs := p.topics[topic]; subs != nil {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(p.topics, topic)
+		}
+	}
+}
+
+// Subscribers returns the sockets which are subscribed to topic
+func (p *PubSub) Subscribers(topic string) []*Sock {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	subs := p.topics[topic]
+	socks := make([]*Sock, 0, len(subs))
+	for s := range subs {
+		socks = append(socks, s)
+	}
+	return socks
+}
+
+// Topics returns the topics which s is subscribed to
+func (p *PubSub) Topics(s *Sock) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	topics := make([]string, 0, len(p.socks[s]))
+	for topic := range p.socks[s] {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Publish sends a notification named topic with v, encoded with each subscriber's codec
+// (see Codec), to all subscribers of topic. See PublishBuffer for details.
+func (p *PubSub) Publish(topic string, v interface{}) error {
+	return notifyAllValue(p.Subscribers(topic), topic, v)
+}
+
+// PublishBuffer sends a notification named topic to all subscribers of topic.
+// Like Server.BroadcastBuffer, the notification is queued for each subscriber and sent in the
+// background, so this function doesn't wait for slow subscribers.
+func (p *PubSub) PublishBuffer(topic string, buf []byte) {
+	notifyAll(p.Subscribers(topic), topic, func(*Sock) []byte { return buf })
+}
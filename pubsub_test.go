@@ -0,0 +1,70 @@
+package gotalk
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestPubSub(t *testing.T) {
+	h := &Handlers{}
+	p := NewPubSub(h)
+	var denials []string
+	defer func(l LoggerFunc) { AccessDeniedLogger = l }(AccessDeniedLogger)
+	AccessDeniedLogger = func(s *Sock, format string, args ...interface{}) {
+		denials = append(denials, fmt.Sprintf(format, args...))
+	}
+	p.Authorize = func(s *Sock, topic string) error {
+		if topic == "secret" {
+			return errors.New("topic is secret")
+		}
+		return nil
+	}
+	received := make(chan string, 4)
+	h.HandleBufferNotification("", func(s *Sock, name string, b []byte) {
+		received <- name + ":" + string(b)
+	})
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+
+	// subscribe s1 to "news" (s2 is the subscriber on the responding end)
+	if _, err := s1.BufferRequest(PubSubSubscribeOp, []byte(`"news"`)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s1.BufferRequest(PubSubSubscribeOp, []byte(`"secret"`))
+	assertError(t, "access denied", err)
+	assertEq(t, 1, len(denials))
+	assertEq(t, `access denied: topic is secret (topic "secret")`, denials[0])
+	assertEq(t, 1, len(p.Subscribers("news")))
+	assertEq(t, s2, p.Subscribers("news")[0])
+	assertEq(t, 0, len(p.Subscribers("secret")))
+
+	if err := p.Publish("news", 1); err != nil {
+		t.Fatal(err)
+	}
+	p.PublishBuffer("weather", []byte("2")) // no subscribers
+	assertEq(t, "news:1", <-received)
+
+	// unsubscribe
+	if _, err := s1.BufferRequest(PubSubUnsubscribeOp, []byte(`"news"`)); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 0, len(p.Subscribers("news")))
+	assertEq(t, 0, len(p.Topics(s2)))
+
+	// sockets are unsubscribed when they close
+	p.Subscribe(s2, "a")
+	p.Subscribe(s2, "b")
+	assertEq(t, 2, len(p.Topics(s2)))
+	s2.Close()
+	assertEq(t, 0, len(p.Topics(s2)))
+	assertEq(t, 0, len(p.Subscribers("a")))
+
+	// subscribing a closed socket has no effect
+	p.Subscribe(s2, "a")
+	assertEq(t, 0, len(p.Subscribers("a")))
+}
@@ -0,0 +1,257 @@
+package gotalk
+
+import (
+	"sync"
+	"time"
+)
+
+// How often a queue checks for a free slot when slots may be freed by other sockets, i.e.
+// when Limits.Shared or Limits.Adaptive is used.
+const requestQueuePollInterval = 10 * time.Millisecond
+
+// queuedReq is a buffer request which is waiting for a free slot
+type queuedReq struct {
+	id       string
+	op       string
+	handler  BufferReqContextHandler
+	inbuf    []byte
+	deadline time.Time // when to stop waiting; the earlier of meta.deadline and Limits.QueueWait
+	meta     msgMeta   // deadline and header set by the requestor, if any
+}
+
+// requestQueue holds buffer requests which arrive when Limits.BufferRequests (or a shared or
+// adaptive limit) has been reached, until a slot is free. See Limits.QueuedRequests.
+// Requests are handled in the order they arrive.
+type requestQueue struct {
+	s     *Sock
+	lim   *limitsImpl
+	freed chan struct{} // signalled by decBufferReq
+
+	mu      sync.Mutex
+	items   []*queuedReq
+	running bool
+}
+
+func (q *requestQueue) init(s *Sock, lim *limitsImpl) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.s = s
+	q.lim = lim
+	q.freed = make(chan struct{}, 1)
+}
+
+// depth returns the number of requests in the queue
+func (q *requestQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// signal is called when a slot has been freed
+func (q *requestQueue) signal() {
+	select {
+	case q.freed <- struct{}{}:
+	default:
+	}
+}
+
+// push adds r to the queue. Returns false if the queue is full.
+func (q *requestQueue) push(r *queuedReq) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if uint32(len(q.items)) >= q.lim.queueSize {
+		return false
+	}
+	q.items = append(q.items, r)
+	if q.lim.shared != nil {
+		q.lim.shared.incQueued()
+	}
+	if !q.running {
+		q.running = true
+		q.s.handlerWg.Add(1)
+		go q.run()
+	}
+	return true
+}
+
+// popLocked removes the first request. q.mu must be locked.
+func (q *requestQueue) popLocked() *queuedReq {
+	r := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	if q.lim.shared != nil {
+		q.lim.shared.decQueued()
+	}
+	return r
+}
+
+// remove removes request id, if queued. Returns false if it wasn't.
+func (q *requestQueue) remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, r := range q.items {
+		if r.id == id {
+			copy(q.items[i:], q.items[i+1:])
+			q.items[len(q.items)-1] = nil
+			q.items = q.items[:len(q.items)-1]
+			if q.lim.shared != nil {
+				q.lim.shared.decQueued()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// run handles queued requests as slots become free and tells the requestors of requests which
+// have waited for too long to retry. It returns when the queue is empty.
+func (q *requestQueue) run() {
+	defer q.s.handlerWg.Done()
+
+	q.mu.Lock()
+	lim, freed := q.lim, q.freed
+	q.mu.Unlock()
+
+	ctx := q.s.connContext()
+
+	var poll <-chan time.Time
+	if lim.shared != nil || lim.adaptive != nil {
+		ticker := time.NewTicker(requestQueuePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		var expired []*queuedReq
+		now := time.Now()
+		for len(q.items) > 0 && !now.Before(q.items[0].deadline) {
+			expired = append(expired, q.popLocked())
+		}
+		var next *queuedReq
+		if len(q.items) > 0 && lim.incBufferReq() {
+			next = q.popLocked()
+		}
+		if len(q.items) == 0 && next == nil && expired == nil {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		var deadline time.Time
+		if len(q.items) > 0 {
+			deadline = q.items[0].deadline
+		}
+		q.mu.Unlock()
+
+		for _, r := range expired {
+			if isExpired(r.meta.deadline) {
+				q.respondError(r.op, r.id, ErrDeadlineExceeded.Error())
+			} else {
+				q.respondRetry(r.op, r.id, lim.waitBufferReq(), "request queue timeout")
+			}
+		}
+		if next != nil {
+			q.dispatch(lim, next)
+			continue
+		}
+		if deadline.IsZero() {
+			continue
+		}
+
+		timer.Reset(time.Until(deadline))
+		select {
+		case <-freed:
+		case <-poll:
+		case <-timer.C:
+		case <-ctx.Done():
+			// the connection has closed; no one is waiting for responses
+			q.mu.Lock()
+			for len(q.items) > 0 {
+				q.popLocked()
+			}
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// dispatch handles a request which has been given a slot
+func (q *requestQueue) dispatch(lim *limitsImpl, r *queuedReq) {
+	releaseOp, wait, refused := q.s.acquireOp(r.op, lim.bufferMinWait, lim.bufferMaxWait)
+	if refused != "" {
+		lim.decBufferReq()
+		q.respondRetry(r.op, r.id, wait, refused)
+		return
+	}
+	q.s.handleBufferReq(lim, r.id, r.op, r.handler, releaseOp, r.inbuf, r.meta)
+}
+
+func (q *requestQueue) respondRetry(op, id string, wait uint32, msg string) {
+	if err := q.s.respondRetry(0, id, wait, msg); err != nil {
+		q.s.logRespondErr(op, err)
+		q.s.close()
+	}
+}
+
+func (q *requestQueue) respondError(op, id string, msg string) {
+	if err := q.s.respondError(0, id, msg); err != nil {
+		q.s.logRespondErr(op, err)
+		q.s.close()
+	}
+}
+
+// queueBufferReq is called when a buffer request arrives while the limit of concurrent buffer
+// requests has been reached. Unless the queue is full the request is queued, or else the
+// requestor is told to retry.
+func (s *Sock) queueBufferReq(
+	lim *limitsImpl, id, op string, size int, meta msgMeta,
+) error {
+	if lim.queueSize == 0 || s.queue.depth() >= int(lim.queueSize) {
+		return s.respondRetry(size, id, lim.waitBufferReq(), "request rate limit")
+	}
+
+	handler := s.Handlers.FindBufferRequestContextHandler(op)
+	if handler == nil {
+		return s.respondError(size, id, "unknown operation \""+op+"\"")
+	}
+	if !s.authorize(op) {
+		return s.respondError(size, id, ErrAccessDenied.Error())
+	}
+
+	inbuf := make([]byte, size)
+	if _, err := readn(s.conn, inbuf); err != nil {
+		return err
+	}
+
+	r := &queuedReq{
+		id:       id,
+		op:       op,
+		handler:  handler,
+		inbuf:    inbuf,
+		deadline: time.Now().Add(lim.queueWait),
+		meta:     meta,
+	}
+	if !meta.deadline.IsZero() && meta.deadline.Before(r.deadline) {
+		r.deadline = meta.deadline
+	}
+	if !s.queue.push(r) {
+		// only the read loop adds to the queue, so this should not happen
+		return s.respondRetry(0, id, lim.waitBufferReq(), "request rate limit")
+	}
+	return nil
+}
+
+// QueuedRequests returns the number of requests waiting in the socket's queue.
+// See Limits.QueuedRequests.
+func (s *Sock) QueuedRequests() int {
+	return s.queue.depth()
+}
@@ -0,0 +1,161 @@
+package gotalk
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestQueue(t *testing.T) {
+	h := &Handlers{}
+	release := make(chan struct{})
+	started := make(chan string, 4)
+	h.HandleBufferRequest("wait", func(s *Sock, op string, b []byte) ([]byte, error) {
+		started <- string(b)
+		<-release
+		return b, nil
+	})
+
+	shared := &SharedLimits{}
+	s1, s2, err := Pipe(h, &Limits{
+		BufferRequests: 1,
+		BufferMinWait:  10 * time.Millisecond,
+		BufferMaxWait:  20 * time.Millisecond,
+		QueuedRequests: 1,
+		QueueWait:      5 * time.Second,
+		Shared:         shared,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	send := func(data string) chan Response {
+		t.Helper()
+		reschan := make(chan Response, 1)
+		if err := s1.SendRequest(NewRequest("wait", []byte(data)), reschan); err != nil {
+			t.Fatal(err)
+		}
+		return reschan
+	}
+
+	// first request is handled, second is queued and third is told to retry
+	res1 := send("1")
+	assertEq(t, "1", <-started)
+	res2 := send("2")
+	waitFor(t, "request to be queued", func() bool { return s2.QueuedRequests() == 1 })
+	assertEq(t, 1, shared.QueuedRequests())
+	res := <-send("3")
+	assertEq(t, true, res.IsRetry())
+	assertEq(t, "request rate limit", string(res.Data))
+
+	// the queued request is handled when the first one finishes
+	release <- struct{}{}
+	assertEq(t, "1", string((<-res1).Data))
+	assertEq(t, "2", <-started)
+	assertEq(t, 0, s2.QueuedRequests())
+	assertEq(t, 0, shared.QueuedRequests())
+	release <- struct{}{}
+	assertEq(t, "2", string((<-res2).Data))
+}
+
+func TestRequestQueueWait(t *testing.T) {
+	h := &Handlers{}
+	release := make(chan struct{})
+	h.HandleBufferRequest("wait", func(s *Sock, op string, b []byte) ([]byte, error) {
+		<-release
+		return b, nil
+	})
+
+	s1, s2, err := Pipe(h, &Limits{
+		BufferRequests: 1,
+		BufferMinWait:  10 * time.Millisecond,
+		BufferMaxWait:  20 * time.Millisecond,
+		QueuedRequests: 4,
+		QueueWait:      50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	defer close(release)
+
+	res1 := make(chan Response, 1)
+	s1.SendRequest(NewRequest("wait", nil), res1)
+
+	// a request which waits in the queue for longer than QueueWait is told to retry
+	start := time.Now()
+	reschan := make(chan Response, 1)
+	if err := s1.SendRequest(NewRequest("wait", []byte("x")), reschan); err != nil {
+		t.Fatal(err)
+	}
+	res := <-reschan
+	assertEq(t, true, res.IsRetry())
+	assertEq(t, "request queue timeout", string(res.Data))
+	assertEq(t, true, time.Since(start) >= 50*time.Millisecond)
+	assertEq(t, 0, s2.QueuedRequests())
+
+	// a cancelled request is removed from the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for s2.QueuedRequests() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	_, err = s1.BufferRequestContext(ctx, "wait", []byte("y"))
+	assertEq(t, context.Canceled, err)
+	waitFor(t, "request to be removed", func() bool { return s2.QueuedRequests() == 0 })
+}
+
+func TestRequestQueueOrder(t *testing.T) {
+	h := &Handlers{}
+	release := make(chan struct{})
+	started := make(chan string, 4)
+	h.HandleBufferRequest("wait", func(s *Sock, op string, b []byte) ([]byte, error) {
+		started <- string(b)
+		<-release
+		return b, nil
+	})
+
+	s1, s2, err := Pipe(h, &Limits{
+		BufferRequests: 1,
+		QueuedRequests: 4,
+		QueueWait:      5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	send := func(data string) chan Response {
+		t.Helper()
+		reschan := make(chan Response, 1)
+		if err := s1.SendRequest(NewRequest("wait", []byte(data)), reschan); err != nil {
+			t.Fatal(err)
+		}
+		return reschan
+	}
+
+	res1 := send("1")
+	assertEq(t, "1", <-started)
+	send("2")
+	waitFor(t, "request to be queued", func() bool { return s2.QueuedRequests() == 1 })
+
+	// Keep the queue from taking the slot which is freed when the first request finishes.
+	// A request which arrives meanwhile must not take it either.
+	s2.queue.mu.Lock()
+	release <- struct{}{}
+	<-res1
+	go s1.SendRequest(NewRequest("wait", []byte("3")), make(chan Response, 1))
+	time.Sleep(20 * time.Millisecond)
+	s2.queue.mu.Unlock()
+
+	assertEq(t, "2", <-started)
+	release <- struct{}{}
+	assertEq(t, "3", <-started)
+	release <- struct{}{}
+}
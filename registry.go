@@ -0,0 +1,223 @@
+package gotalk
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sockRegistry keeps track of connected sockets.
+// Embedded in Server and WebSocketServer which register the sockets they accept.
+type sockRegistry struct {
+	socksMu     sync.RWMutex
+	socks       map[uint64]*Sock
+	socksClosed bool // true when no more sockets can be added
+}
+
+var nextSockID uint64 // atomic
+
+// ID returns a number which uniquely identifies the socket during the lifetime of the process.
+// The ID stays the same when a socket reconnects (see ConnectKeepAlive.)
+func (s *Sock) ID() uint64 {
+	if id := atomic.LoadUint64(&s.id); id != 0 {
+		return id
+	}
+	atomic.CompareAndSwapUint64(&s.id, 0, atomic.AddUint64(&nextSockID, 1))
+	return atomic.LoadUint64(&s.id)
+}
+
+// Sockets returns all sockets which are currently connected
+func (r *sockRegistry) Sockets() []*Sock {
+	r.socksMu.RLock()
+	defer r.socksMu.RUnlock()
+	socks := make([]*Sock, 0, len(r.socks))
+	for _, s := range r.socks {
+		socks = append(socks, s)
+	}
+	return socks
+}
+
+// Len returns the number of sockets which are currently connected
+func (r *sockRegistry) Len() int {
+	r.socksMu.RLock()
+	defer r.socksMu.RUnlock()
+	return len(r.socks)
+}
+
+// SockByID returns the connected socket with the provided ID (see Sock.ID), or nil if there's
+// no such socket.
+func (r *sockRegistry) SockByID(id uint64) *Sock {
+	r.socksMu.RLock()
+	defer r.socksMu.RUnlock()
+	return r.socks[id]
+}
+
+// Broadcast sends a notification with v, encoded with each socket's codec (see Codec), to all
+// connected sockets. See BroadcastBufferFilter for details.
+func (r *sockRegistry) Broadcast(name string, v interface{}) error {
+	return r.BroadcastFilter(name, v, nil)
+}
+
+// BroadcastFilter sends a notification with v, encoded with each socket's codec, to all
+// connected sockets for which filter returns true. See BroadcastBufferFilter for details.
+func (r *sockRegistry) BroadcastFilter(name string, v interface{}, filter func(*Sock) bool) error {
+	return notifyAllValue(filterSocks(r.Sockets(), filter), name, v)
+}
+
+// BroadcastBuffer sends a notification to all connected sockets.
+// See BroadcastBufferFilter for details.
+func (r *sockRegistry) BroadcastBuffer(name string, buf []byte) {
+	r.BroadcastBufferFilter(name, buf, nil)
+}
+
+// BroadcastBufferFilter sends a notification to all connected sockets for which filter returns
+// true. If filter is nil, the notification is sent to all connected sockets.
+//
+// The notification is queued for each socket and sent in the background, so that a slow peer
+// does not delay the caller or delivery to others. Notifications are sent to each socket in the
+// order they were broadcast. A socket which has more than maxQueuedNotes notifications waiting
+// to be sent misses out on further notifications until it has caught up, which is logged with
+// ErrorLogger. Errors are ignored; a socket which has lost its connection is unregistered as
+// soon as its read loop ends.
+func (r *sockRegistry) BroadcastBufferFilter(name string, buf []byte, filter func(*Sock) bool) {
+	notifyAll(filterSocks(r.Sockets(), filter), name, func(*Sock) []byte { return buf })
+}
+
+// filterSocks removes sockets for which filter returns false, in place
+func filterSocks(socks []*Sock, filter func(*Sock) bool) []*Sock {
+	if filter == nil {
+		return socks
+	}
+	n := 0
+	for _, s := range socks {
+		if filter(s) {
+			socks[n] = s
+			n++
+		}
+	}
+	return socks[:n]
+}
+
+// notifyAll queues a notification with payload(s) for each socket (see Sock.queueNotification)
+func notifyAll(socks []*Sock, name string, payload func(*Sock) []byte) {
+	for _, s := range socks {
+		s.queueNotification(name, payload(s))
+	}
+}
+
+// notifyAllValue is like notifyAll but sends v encoded with each socket's codec.
+// v is encoded once per codec.
+func notifyAllValue(socks []*Sock, name string, v interface{}) error {
+	bufs := make(map[string][]byte) // keyed by codec name
+	for _, s := range socks {
+		c := s.codec()
+		if _, ok := bufs[c.Name()]; !ok {
+			buf, err := c.Marshal(v)
+			if err != nil {
+				return err
+			}
+			bufs[c.Name()] = buf
+		}
+	}
+	notifyAll(socks, name, func(s *Sock) []byte { return bufs[s.codec().Name()] })
+	return nil
+}
+
+// addSock registers s. Returns false if the registry has been closed.
+func (r *sockRegistry) addSock(s *Sock) bool {
+	r.socksMu.Lock()
+	defer r.socksMu.Unlock()
+	if r.socksClosed {
+		return false
+	}
+	if r.socks == nil {
+		r.socks = make(map[uint64]*Sock)
+	}
+	r.socks[s.ID()] = s
+	return true
+}
+
+func (r *sockRegistry) removeSock(s *Sock) {
+	r.socksMu.Lock()
+	delete(r.socks, s.ID())
+	r.socksMu.Unlock()
+}
+
+// closeSocks prevents any more sockets from being registered and returns the sockets which
+// are currently registered.
+func (r *sockRegistry) closeSocks() []*Sock {
+	r.socksMu.Lock()
+	r.socksClosed = true
+	r.socksMu.Unlock()
+	return r.Sockets()
+}
+
+// ----------------------------------------------------------------------------------------------
+
+// Max number of broadcast notifications waiting to be sent to a socket
+const maxQueuedNotes = 1024
+
+// Time after which a noteQueue's goroutine exits when there's nothing to send
+const noteQueueIdleTimeout = 10 * time.Second
+
+type queuedNote struct {
+	name string
+	buf  []byte
+}
+
+// noteQueue holds notifications which have been broadcast to a socket but not yet sent.
+// A goroutine sends them while there are any, and for a while after, so that broadcasting
+// neither waits for the socket nor starts a goroutine per socket and notification.
+type noteQueue struct {
+	mu      sync.Mutex
+	ch      chan queuedNote
+	running bool
+}
+
+// queueNotification queues a notification to be sent by the socket's note queue goroutine.
+// Returns false if the queue is full, in which case the notification is dropped.
+func (s *Sock) queueNotification(name string, buf []byte) bool {
+	q := &s.noteQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ch == nil {
+		q.ch = make(chan queuedNote, maxQueuedNotes)
+	}
+	select {
+	case q.ch <- queuedNote{name, buf}:
+	default:
+		ErrorLogger(s, "dropped notification %q: too many queued notifications", name)
+		return false
+	}
+	if !q.running {
+		q.running = true
+		go s.sendQueuedNotes(q)
+	}
+	return true
+}
+
+func (s *Sock) sendQueuedNotes(q *noteQueue) {
+	timer := time.NewTimer(noteQueueIdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case n := <-q.ch:
+			s.BufferNotify(n.name, n.buf) // ignore error
+		case <-timer.C:
+			q.mu.Lock()
+			if len(q.ch) == 0 {
+				q.running = false
+				q.mu.Unlock()
+				return
+			}
+			q.mu.Unlock()
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(noteQueueIdleTimeout)
+	}
+}
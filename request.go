@@ -1,32 +1,65 @@
 package gotalk
 
+import "context"
+
 type Request struct {
 	MsgType
-	Op   string
-	Data []byte
+	Op     string
+	Data   []byte
+	Header Header // sent if the responder supports headers (see Header)
 }
 
 // Creates a new single request
 func NewRequest(op string, buf []byte) *Request {
-	return &Request{MsgTypeSingleReq, op, buf}
+	return &Request{MsgType: MsgTypeSingleReq, Op: op, Data: buf}
 }
 
 type StreamRequest struct {
 	sock    *Sock
 	op      string
 	id      string
-	started bool // request started?
+	started bool          // request started?
+	credit  *streamCredit // flow control (see Limits.StreamWindow)
 }
 
+// Write sends b as the next part of the request. If the responder uses flow control, Write
+// waits until the responder is ready to receive more data.
 func (r *StreamRequest) Write(b []byte) error {
+	return r.write(context.Background(), b)
+}
+
+func (r *StreamRequest) write(ctx context.Context, b []byte) error {
+	s := r.sock
 	if r.started == false {
 		r.started = true
-		if err := r.sock.writeMsg(MsgTypeStreamReq, r.id, r.op, 0, b); err != nil {
+		r.credit = s.openCredit(MsgTypeStreamReqWindow, r.id)
+		window := s.streamWindow()
+		if !s.peerSupports(capFlow) {
+			window = 0 // the responder doesn't understand window updates
+		}
+		if window > 0 {
+			s.startResQueue(r.id, window)
+		}
+		// the request is preceded by the window of its results, if any
+		header, _ := ctx.Value(outHeaderKey).(Header)
+		err := s.writeReqMsg(ctx, MsgTypeStreamReq, r.id, r.op, header, window, b)
+		if err != nil {
 			r.finalize()
 			return err
 		}
+		r.credit.take(ctx, len(b)) // never waits since no window has been granted yet
+		if s.peerWindow() > 0 {
+			// the responder grants its window in response to the request; wait for it
+			r.credit.limit()
+		}
 	} else {
-		if err := r.sock.writeMsg(MsgTypeStreamReqPart, r.id, "", 0, b); err != nil {
+		if !s.peerAccepts(len(b)) {
+			return ErrPayloadTooLarge
+		}
+		if err := r.credit.take(ctx, len(b)); err != nil {
+			return err
+		}
+		if err := s.writeMsg(MsgTypeStreamReqPart, r.id, "", 0, b); err != nil {
 			r.finalize()
 			return err
 		}
@@ -34,10 +67,13 @@ func (r *StreamRequest) Write(b []byte) error {
 	return nil
 }
 
+// End ends the request stream
 func (r *StreamRequest) End() error {
 	err := r.sock.writeMsg(MsgTypeStreamReqPart, r.id, "", 0, nil)
 	if err != nil {
 		r.finalize()
+	} else {
+		r.sock.closeCredit(MsgTypeStreamReqWindow, r.id)
 	}
 	return err
 }
@@ -45,6 +81,7 @@ func (r *StreamRequest) End() error {
 func (r *StreamRequest) finalize() {
 	if r.id != "" {
 		r.sock.forgetResChan(r.id)
+		r.sock.closeCredit(MsgTypeStreamReqWindow, r.id)
 		r.id = ""
 	}
 }
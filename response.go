@@ -6,6 +6,10 @@ type Response struct {
 	MsgType
 	Data []byte
 	Wait time.Duration // only valid when IsRetry()==true
+
+	Header Header // header sent by the responder, if any (see Header)
+
+	connLost bool // true if the response was produced locally because the connection closed
 }
 
 // Returns a string describing the error, when IsError()==true
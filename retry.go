@@ -0,0 +1,178 @@
+package gotalk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls how BufferRequest and the functions built on it (Request, Call, etc.)
+// retry requests which the responder can't handle right now (see Response.IsRetry.)
+// See Sock.RetryPolicy.
+//
+// The time to wait before retrying is the wait time suggested by the responder, or MinWait if
+// that is longer, multiplied by Multiplier for every retry after the first and with up to
+// Jitter of random time added. A request is never retried sooner than the responder asked for.
+// When the policy is exhausted the request fails with a *RetryError.
+type RetryPolicy struct {
+	MaxAttempts int           // max number of attempts, including the first one (0=no limit)
+	MaxElapsed  time.Duration // give up when a retry would start later than this (0=no limit)
+
+	Multiplier float64       // back-off factor applied to the wait for each retry (<=1 means none)
+	Jitter     float64       // max random time to add, as a fraction of the wait (e.g. 0.2)
+	MinWait    time.Duration // min time to wait before retrying
+	MaxWait    time.Duration // max time to wait, unless the responder asks for longer (0=no limit)
+
+	// RetryConnErrors causes requests which fail because the connection was lost to be sent
+	// again once the socket has reconnected (see Sock.ConnectKeepAlive), just like with
+	// KeepAlive.PendingRequests=PendingRequestsQueue. Such retries count as attempts too.
+	RetryConnErrors bool
+
+	// Budget, if not nil, limits the number of retries in relation to the number of requests
+	Budget *RetryBudget
+}
+
+// RetryBudget limits retries to a fraction of all requests, so that retries don't add to the
+// load of a responder which is already overloaded. Each request adds Ratio to the budget and
+// each retry takes 1 from it. A RetryBudget can be shared by several sockets and policies.
+type RetryBudget struct {
+	Ratio float64 // retries allowed per request, e.g. 0.1 for 10%
+	Max   float64 // max size of the budget, which is also its initial size (default 10)
+
+	mu          sync.Mutex
+	initialized bool
+	tokens      float64
+}
+
+func (b *RetryBudget) init() {
+	if !b.initialized {
+		b.initialized = true
+		b.tokens = b.max()
+	}
+}
+
+func (b *RetryBudget) max() float64 {
+	if b.Max <= 0 {
+		return 10
+	}
+	return b.Max
+}
+
+// deposit is called for each new request
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	b.tokens = math.Min(b.max(), b.tokens+b.Ratio)
+}
+
+// withdraw is called for each retry. Returns false if the budget has been used up.
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RetryError is returned when a request fails because its RetryPolicy has been exhausted
+type RetryError struct {
+	Attempts int   // number of attempts made
+	Err      error // error of the last attempt; a *Response for retry responses
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// wait returns how long to wait before retry number n (1 for the first retry) when the
+// responder asked us to wait for hint
+func (p *RetryPolicy) wait(hint time.Duration, n int) time.Duration {
+	d := hint
+	if d < p.MinWait {
+		d = p.MinWait
+	}
+	if p.Multiplier > 1 && n > 1 {
+		d = time.Duration(float64(d) * math.Pow(p.Multiplier, float64(n-1)))
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	if p.MaxWait > 0 && d > p.MaxWait {
+		d = p.MaxWait
+		if d < hint {
+			d = hint
+		}
+	}
+	return d
+}
+
+// retryState tracks the attempts of one request
+type retryState struct {
+	policy   *RetryPolicy // nil means retry forever
+	start    time.Time
+	attempts int
+}
+
+func newRetryState(p *RetryPolicy) *retryState {
+	r := &retryState{policy: p, start: time.Now(), attempts: 1}
+	if p != nil && p.Budget != nil {
+		p.Budget.deposit()
+	}
+	return r
+}
+
+// next is called when an attempt failed with err and the responder asked us to wait for hint.
+// It returns how long to wait before the next attempt, or a *RetryError if we should give up.
+func (r *retryState) next(hint time.Duration, err error) (time.Duration, error) {
+	p := r.policy
+	if p == nil {
+		return hint, nil
+	}
+	if p.MaxAttempts > 0 && r.attempts >= p.MaxAttempts {
+		return 0, &RetryError{r.attempts, err}
+	}
+	d := p.wait(hint, r.attempts)
+	if p.MaxElapsed > 0 && time.Since(r.start)+d > p.MaxElapsed {
+		return 0, &RetryError{r.attempts, err}
+	}
+	if p.Budget != nil && !p.Budget.withdraw() {
+		return 0, &RetryError{r.attempts, err}
+	}
+	r.attempts++
+	return d, nil
+}
+
+// awaitConnection waits for the socket to reconnect after an attempt failed with err because
+// the connection was lost. Returns a *RetryError if the policy is exhausted before then.
+func (r *retryState) awaitConnection(
+	ctx context.Context, k *keepAlive, prev io.ReadWriteCloser, err error,
+) error {
+	if _, err := r.next(0, err); err != nil {
+		return err
+	}
+	actx := ctx
+	if r.policy != nil && r.policy.MaxElapsed > 0 {
+		var cancel context.CancelFunc
+		actx, cancel = context.WithDeadline(ctx, r.start.Add(r.policy.MaxElapsed))
+		defer cancel()
+	}
+	if e := k.awaitConnection(actx, prev); e != nil {
+		if ctx.Err() == nil && actx.Err() != nil {
+			return &RetryError{r.attempts - 1, err} // the last attempt was never made
+		}
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package gotalk
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyWait(t *testing.T) {
+	p := &RetryPolicy{Multiplier: 2, MinWait: 10 * time.Millisecond, MaxWait: time.Second}
+	assertEq(t, 10*time.Millisecond, p.wait(0, 1))
+	assertEq(t, 100*time.Millisecond, p.wait(100*time.Millisecond, 1))
+	assertEq(t, 400*time.Millisecond, p.wait(100*time.Millisecond, 3))
+	assertEq(t, time.Second, p.wait(100*time.Millisecond, 5))
+	// never shorter than what the responder asked for
+	assertEq(t, 2*time.Second, p.wait(2*time.Second, 1))
+
+	p = &RetryPolicy{Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := p.wait(100*time.Millisecond, 1)
+		assertEq(t, true, d >= 100*time.Millisecond && d <= 150*time.Millisecond)
+	}
+}
+
+func TestRetryMaxElapsed(t *testing.T) {
+	p := &RetryPolicy{MaxElapsed: time.Hour, MinWait: 20 * time.Minute}
+	errRetry := errors.New("retry")
+
+	r := newRetryState(p)
+	r.start = time.Now().Add(-30 * time.Minute)
+	d, err := r.next(0, errRetry)
+	assertEq(t, nil, err)
+	assertEq(t, 20*time.Minute, d)
+	assertEq(t, 2, r.attempts)
+
+	// gives up rather than waiting past MaxElapsed
+	r.start = time.Now().Add(-45 * time.Minute)
+	_, err = r.next(0, errRetry)
+	var retryErr *RetryError
+	assertEq(t, true, errors.As(err, &retryErr))
+	assertEq(t, 2, retryErr.Attempts)
+	assertEq(t, errRetry, retryErr.Err)
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &RetryBudget{Ratio: 0.5, Max: 2}
+	assertEq(t, true, b.withdraw())
+	assertEq(t, true, b.withdraw())
+	assertEq(t, false, b.withdraw())
+	b.deposit()
+	assertEq(t, false, b.withdraw())
+	b.deposit()
+	assertEq(t, true, b.withdraw())
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	assertEq(t, float64(2), b.tokens)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	h := &Handlers{}
+	release := make(chan struct{})
+	h.HandleBufferRequest("wait", func(s *Sock, op string, b []byte) ([]byte, error) {
+		<-release
+		return b, nil
+	})
+	s1, s2, err := Pipe(h, &Limits{
+		BufferRequests: 1,
+		BufferMinWait:  time.Millisecond,
+		BufferMaxWait:  2 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	defer close(release)
+
+	// occupy the responder's only slot
+	s1.SendRequest(NewRequest("wait", nil), make(chan Response, 1))
+
+	s1.RetryPolicy = &RetryPolicy{MaxAttempts: 3}
+	_, err = s1.BufferRequest("wait", nil)
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected RetryError, got %v", err)
+	}
+	assertEq(t, 3, retryErr.Attempts)
+	assertError(t, "gave up after 3 attempts: request rate limit", err)
+	res, ok := retryErr.Err.(*Response)
+	assertEq(t, true, ok && res.IsRetry())
+
+	s1.RetryPolicy = &RetryPolicy{MaxElapsed: 50 * time.Millisecond, MinWait: 20 * time.Millisecond}
+	_, err = s1.BufferRequest("wait", nil)
+	assertEq(t, true, errors.As(err, &retryErr))
+
+	s1.RetryPolicy = &RetryPolicy{Budget: &RetryBudget{Max: 1}}
+	_, err = s1.BufferRequest("wait", nil)
+	assertEq(t, true, errors.As(err, &retryErr))
+	assertEq(t, 2, retryErr.Attempts)
+}
+
+func TestRetryConnErrors(t *testing.T) {
+	h := &Handlers{}
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+
+	server, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Handlers = h
+	accepted := make(chan *Sock, 4)
+	server.AcceptHandler = func(s *Sock) { accepted <- s }
+	go server.Accept()
+
+	s := NewSock(h)
+	s.RetryPolicy = &RetryPolicy{RetryConnErrors: true, MaxAttempts: 2}
+	err = s.ConnectKeepAlive(&KeepAlive{
+		Dial: func() (io.ReadWriteCloser, error) {
+			return net.Dial("tcp", server.Addr())
+		},
+		MinDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The server drops the connection. The request is sent again once the socket has
+	// reconnected, even though KeepAlive.PendingRequests is PendingRequestsFail.
+	(<-accepted).Close()
+	buf, err := s.BufferRequest("echo", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytes(t, []byte("1"), buf)
+	<-accepted
+}
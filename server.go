@@ -1,16 +1,22 @@
 package gotalk
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type SockHandler func(*Sock)
 
+// ErrServerClosed is returned by Server.Accept after the server has been closed
+var ErrServerClosed = errors.New("server closed")
+
 // Accepts socket connections
 type Server struct {
 	// Handlers associated with this server. Accepted sockets inherit the value.
@@ -31,8 +37,20 @@ type Server struct {
 	// Template value for accepted sockets. Defaults to nil
 	OnHeartbeat func(load int, t time.Time)
 
+	// Authenticator, if not nil, authenticates accepted sockets right after the handshake,
+	// before AcceptHandler is called. Sockets it rejects are closed.
+	// The credentials include the TLS connection state for TLS connections.
+	Authenticator Authenticator
+
 	// Transport
 	Listener net.Listener
+
+	// Accepted sockets which are connected. See Sockets, Broadcast, etc.
+	sockRegistry
+
+	mu       sync.Mutex     // protects Listener once accepting, closed and acceptWg.Add
+	closed   bool           // true after Close
+	acceptWg sync.WaitGroup // accept goroutines which are running
 }
 
 // Create a new server already listening on `l`
@@ -116,12 +134,22 @@ func Serve(how, addr string, acceptHandler SockHandler) error {
 	return s.Accept()
 }
 
-// Accept connections. Blocks until Close() is called or an error occurs.
+// Accept connections. Blocks until Close() is called, in which case ErrServerClosed is
+// returned, or an error occurs.
 func (s *Server) Accept() error {
+	s.mu.Lock()
+	l, closed := s.Listener, s.closed
+	s.mu.Unlock()
+	if closed || l == nil {
+		return ErrServerClosed
+	}
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
-		c, e := s.Listener.Accept()
+		c, e := l.Accept()
 		if e != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -136,14 +164,51 @@ func (s *Server) Accept() error {
 			}
 			return e
 		}
+		// acceptWg.Add must not race with acceptWg.Wait in Shutdown, which happens after Close
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return ErrServerClosed
+		}
+		s.acceptWg.Add(1)
+		s.mu.Unlock()
 		go s.accept(c)
 	}
 }
 
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
 func (s *Server) accept(c net.Conn) {
+	defer s.acceptWg.Done()
+	done, ok := acceptConn(s.Limits, c.RemoteAddr().String())
+	if !ok {
+		c.Close()
+		return
+	}
+	defer done()
 	s2 := NewSock(s.Handlers)
 	s2.Adopt(c)
-	if err := s2.Handshake(); err == nil {
+	if err := s2.handshake(s.Limits); err == nil {
+		if s.Authenticator != nil {
+			creds := &Credentials{}
+			if tc, ok := c.(*tls.Conn); ok {
+				state := tc.ConnectionState()
+				creds.TLS = &state
+			}
+			if s2.authenticate(s.Authenticator, creds) != nil {
+				return
+			}
+		}
+		if !s.addSock(s2) {
+			s2.Close()
+			return
+		}
+		defer s.removeSock(s2)
 		if s.AcceptHandler != nil {
 			s.AcceptHandler(s2)
 		}
@@ -155,25 +220,82 @@ func (s *Server) accept(c net.Conn) {
 
 // Address this server is listening at
 func (s *Server) Addr() string {
-	if s.Listener != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Listener != nil && !s.closed {
 		return s.Listener.Addr().String()
 	}
 	return ""
 }
 
+// Shut down the server gracefully: Stop accepting connections, shut down all accepted sockets
+// (see Sock.Shutdown) and wait for request handlers to finish.
+//
+// If ctx is done before all sockets have shut down, any remaining sockets are closed, which
+// cancels the contexts of their handlers, and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	socks := s.closeSocks()
+	err := s.Close()
+
+	// Give sockets a short time to finish reading messages which are in flight
+	timeout := serverShutdownTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	var wg sync.WaitGroup
+	for _, s2 := range socks {
+		wg.Add(1)
+		if s2.Shutdown(&wg, timeout) == ErrSockClosed {
+			wg.Done() // already shutting down
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()         // sockets have shut down and their handlers have returned
+		s.acceptWg.Wait() // sockets which were being accepted have been closed too
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Close the remaining sockets, which cancels the contexts of their handlers, and give the
+	// handlers a short time to return
+	for _, s2 := range socks {
+		s2.Close()
+	}
+	for _, s2 := range s.Sockets() {
+		s2.Close()
+	}
+	timer := time.NewTimer(serverShutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	return ctx.Err()
+}
+
 // Stop listening for and accepting connections
 func (s *Server) Close() error {
-	if s.Listener != nil {
-		err := s.Listener.Close()
-		s.Listener = nil
-		return err
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Listener == nil || s.closed {
+		return nil
 	}
-	return nil
+	s.closed = true
+	return s.Listener.Close()
 }
 
 // --------------------------------------------------------------
 // internals
 
+// Time given to sockets to finish reading messages when the server shuts down
+const serverShutdownTimeout = 500 * time.Millisecond
+
 type tcpKeepAliveListener struct {
 	*net.TCPListener
 }
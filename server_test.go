@@ -0,0 +1,416 @@
+package gotalk
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// startTestServer starts a server listening on a local TCP port
+func startTestServer(t *testing.T, h *Handlers) *Server {
+	t.Helper()
+	server, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handlers = h
+	go server.Accept()
+	return server
+}
+
+// connectTestServer connects a socket to a server listening on a local TCP port and returns
+// both ends once they know each other's capabilities
+func connectTestServer(t *testing.T, h *Handlers, limits *Limits) (*Sock, *Sock) {
+	t.Helper()
+	server, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handlers = h
+	server.Limits = limits
+	accepted := make(chan *Sock, 1)
+	server.AcceptHandler = func(s *Sock) { accepted <- s }
+	go server.Accept()
+	t.Cleanup(func() { server.Close() })
+
+	c := NewSock(h)
+	if err := c.Connect("tcp", server.Addr(), limits); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	s := <-accepted
+	waitFor(t, "capabilities", func() bool {
+		return c.peerCapsAreKnown() && s.peerCapsAreKnown()
+	})
+	return c, s
+}
+
+func TestServerShutdown(t *testing.T) {
+	h := &Handlers{}
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	h.HandleBufferRequestContext("slow", func(
+		ctx context.Context, s *Sock, op string, b []byte) ([]byte, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			return b, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+
+	server := startTestServer(t, h)
+	c, err := Connect("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A request which is being handled when the server shuts down should complete
+	result := make(chan error, 1)
+	go func() {
+		buf, err := c.BufferRequest("slow", []byte("hello"))
+		if err == nil {
+			assertBytes(t, []byte("hello"), buf)
+		}
+		result <- err
+	}()
+	<-started
+
+	shutdownResult := make(chan error, 1)
+	go func() {
+		shutdownResult <- server.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdownResult:
+		t.Fatalf("Shutdown returned before the handler finished (err %v)", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-shutdownResult; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "client to be disconnected", c.IsClosed)
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	h := &Handlers{}
+	started := make(chan struct{}, 1)
+	returned := make(chan struct{})
+	h.HandleBufferRequestContext("stuck", func(
+		ctx context.Context, s *Sock, op string, b []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		close(returned)
+		return nil, ctx.Err()
+	})
+
+	server := startTestServer(t, h)
+	c, err := Connect("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.BufferRequest("stuck", nil)
+		result <- err
+	}()
+	<-started
+
+	// The handler does not finish in time, so the socket should be closed forcefully
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assertEq(t, context.DeadlineExceeded, server.Shutdown(ctx))
+	select {
+	case <-returned:
+	default:
+		t.Fatal("Shutdown returned before the cancelled handler did")
+	}
+	if err := <-result; err == nil {
+		t.Fatal("expected request to fail")
+	}
+}
+
+func TestServerShutdownWhileAccepting(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handlers = &Handlers{}
+	addr := server.Addr()
+	accepted := make(chan error, 1)
+	go func() { accepted <- server.Accept() }()
+
+	// keep connecting while the server shuts down
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if c, err := net.Dial("tcp", addr); err == nil {
+					c.Close()
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+	assertEq(t, ErrServerClosed, <-accepted)
+	assertEq(t, "", server.Addr())
+	assertEq(t, ErrServerClosed, server.Accept())
+}
+
+func TestSockShutdownAfterRead(t *testing.T) {
+	s1, s2, err := Pipe(&Handlers{}, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	s1.Close()
+	waitFor(t, "read loop to end", func() bool {
+		s1.shutdownMu.Lock()
+		defer s1.shutdownMu.Unlock()
+		return s1.readEnded
+	})
+
+	// Read has returned, so Shutdown must finish the shutdown itself
+	var wg sync.WaitGroup
+	wg.Add(1)
+	assertEq(t, nil, s1.Shutdown(&wg, time.Second))
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for shutdown")
+	}
+}
+
+func TestServerSockets(t *testing.T) {
+	server := startTestServer(t, &Handlers{})
+	defer server.Close()
+
+	// connect two clients which record the notifications they receive
+	received := make([]chan string, 2)
+	for i := range received {
+		ch := make(chan string, 4)
+		received[i] = ch
+		h := &Handlers{}
+		h.HandleBufferNotification("news", func(s *Sock, name string, b []byte) {
+			ch <- string(b)
+		})
+		c := NewSock(h)
+		if err := c.Connect("tcp", server.Addr(), nil); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	waitFor(t, "sockets to be registered", func() bool { return server.Len() == 2 })
+
+	socks := server.Sockets()
+	assertEq(t, 2, len(socks))
+	for _, s := range socks {
+		assertEq(t, s, server.SockByID(s.ID()))
+	}
+	assertEq(t, (*Sock)(nil), server.SockByID(0))
+
+	server.BroadcastBuffer("news", []byte("1"))
+	assertEq(t, "1", <-received[0])
+	assertEq(t, "1", <-received[1])
+
+	// send only to the socket with the lowest ID
+	first := socks[0]
+	if socks[1].ID() < first.ID() {
+		first = socks[1]
+	}
+	if err := server.BroadcastFilter("news", 2, func(s *Sock) bool {
+		return s == first
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-received[0]:
+		assertEq(t, "2", b)
+	case b := <-received[1]:
+		assertEq(t, "2", b)
+	}
+	select {
+	case b := <-received[0]:
+		t.Fatalf("unexpected notification %q", b)
+	case b := <-received[1]:
+		t.Fatalf("unexpected notification %q", b)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// closed sockets are unregistered
+	first.Close()
+	waitFor(t, "socket to be unregistered", func() bool { return server.Len() == 1 })
+	assertEq(t, (*Sock)(nil), server.SockByID(first.ID()))
+}
+
+func TestBroadcastSlowPeer(t *testing.T) {
+	defer func(l LoggerFunc) { ErrorLogger = l }(ErrorLogger)
+	ErrorLogger = func(s *Sock, format string, args ...interface{}) {}
+
+	// a socket whose peer never reads, so writes to it block
+	stuck := NewSock(&Handlers{})
+	c1, c2 := net.Pipe()
+	stuck.Adopt(c1)
+	defer stuck.Close()
+	defer c2.Close() // unblocks the write to the stuck peer
+
+	received := make(chan string, 1)
+	h := &Handlers{}
+	h.HandleBufferNotification("news", func(s *Sock, name string, b []byte) {
+		received <- string(b)
+	})
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	var r sockRegistry
+	r.addSock(stuck)
+	r.addSock(s1)
+
+	// the stuck peer doesn't hold up the broadcaster or the other peer
+	for i := 0; i < maxQueuedNotes+10; i++ {
+		r.BroadcastBuffer("news", []byte("x"))
+		assertEq(t, "x", <-received)
+	}
+	// and the notifications queued for it are bounded
+	assertEq(t, true, len(stuck.noteQueue.ch) <= maxQueuedNotes)
+}
+
+func TestServerSharedLimits(t *testing.T) {
+	h := &Handlers{}
+	release := make(chan struct{})
+	h.HandleBufferRequest("slow", func(s *Sock, op string, b []byte) ([]byte, error) {
+		<-release
+		return b, nil
+	})
+	shared := &SharedLimits{Requests: 1, ConnectionsPerIP: 2}
+	server, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handlers = h
+	server.Limits = &Limits{BufferRequests: Unlimited, Shared: shared}
+	go server.Accept()
+	defer server.Close()
+
+	c1, err := Connect("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := Connect("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// a third connection from the same IP is closed right away
+	c3, err := Connect("tcp", server.Addr())
+	if err == nil {
+		waitFor(t, "connection to be closed", c3.IsClosed)
+	}
+
+	// a request on one socket uses up the server's request limit for the other socket
+	done := make(chan error, 1)
+	go func() {
+		_, err := c1.BufferRequest("slow", nil)
+		done <- err
+	}()
+	waitFor(t, "request to start", func() bool { return shared.ActiveRequests() == 1 })
+	reschan := make(chan Response, 1)
+	if err := c2.SendRequest(NewRequest("slow", nil), reschan); err != nil {
+		t.Fatal(err)
+	}
+	res := <-reschan
+	assertEq(t, true, res.IsRetry())
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebSocketClientAddr(t *testing.T) {
+	// connections through a proxy are limited per client, not per proxy
+	h := &Handlers{}
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+	wss := NewWebSocketServer()
+	wss.Handlers = h
+	wss.Limits = &Limits{BufferRequests: Unlimited, Shared: &SharedLimits{ConnectionsPerIP: 1}}
+	wss.ClientAddr = func(r *http.Request) string {
+		return r.Header.Get("X-Forwarded-For")
+	}
+	hs := httptest.NewServer(wss)
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	connect := func(clientAddr string) (*Sock, error) {
+		config, err := websocket.NewConfig(url, hs.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Header.Set("X-Forwarded-For", clientAddr)
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewSock(&Handlers{})
+		return s, s.ConnectReader(ws, DefaultLimits)
+	}
+
+	for _, addr := range []string{"1.1.1.1", "2.2.2.2"} {
+		s, err := connect(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err := s.BufferRequest("echo", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a second connection from the same client is closed right away
+	s, err := connect("1.1.1.1")
+	if err == nil {
+		waitFor(t, "connection to be closed", s.IsClosed)
+	}
+	s.Close()
+}
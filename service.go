@@ -0,0 +1,78 @@
+package gotalk
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// HandleService registers the exported methods of svc as operations named
+// prefix + "." + MethodName, or just MethodName if prefix is empty.
+// Each method must conform to one of the signatures accepted by Handle.
+// For example, given:
+//
+//   type Calc struct{}
+//   func (c *Calc) Add(args [2]int) (int, error) { return args[0] + args[1], nil }
+//   func (c *Calc) Reset(s *gotalk.Sock) error   { ... }
+//
+// HandleService("calc", &Calc{}) registers the operations "calc.Add" and "calc.Reset".
+//
+// An error is returned, and nothing is registered, if svc has no exported methods or if any
+// exported method has an unsupported signature. Use HandleServiceFunc to skip methods.
+func (h *Handlers) HandleService(prefix string, svc interface{}) error {
+	return h.HandleServiceFunc(prefix, svc, nil)
+}
+
+// HandleServiceFunc is like HandleService but calls opName to name the operation of each
+// exported method. If opName returns an empty string, the method is skipped.
+// If opName is nil, methods are named as described for HandleService.
+func (h *Handlers) HandleServiceFunc(
+	prefix string, svc interface{}, opName func(prefix, method string) string) error {
+	if opName == nil {
+		opName = defaultServiceOpName
+	}
+	if svc == nil {
+		return errors.New("HandleService: svc is nil")
+	}
+	svcv := reflect.ValueOf(svc)
+	svct := svcv.Type()
+	if svct.NumMethod() == 0 {
+		return fmt.Errorf("HandleService: type %s has no exported methods", svct)
+	}
+
+	// wrap all methods before registering any of them
+	ops := make([]string, 0, svct.NumMethod())
+	handlers := make([]BufferReqContextHandler, 0, svct.NumMethod())
+	for i := 0; i < svct.NumMethod(); i++ {
+		method := svct.Method(i)
+		op := opName(prefix, method.Name)
+		if op == "" {
+			continue
+		}
+		handler, err := makeFuncReqHandler(svcv.Method(i).Interface())
+		if err != nil {
+			return fmt.Errorf("HandleService: method %s.%s: %v", svct, method.Name, err)
+		}
+		ops = append(ops, op)
+		handlers = append(handlers, handler)
+	}
+	if len(ops) == 0 {
+		return errors.New("HandleService: no methods to register")
+	}
+	for i, op := range ops {
+		h.HandleBufferRequestContext(op, handlers[i])
+	}
+	return nil
+}
+
+func defaultServiceOpName(prefix, method string) string {
+	if prefix == "" {
+		return method
+	}
+	return prefix + "." + method
+}
+
+// Register the exported methods of svc with DefaultHandlers. See Handlers.HandleService
+func HandleService(prefix string, svc interface{}) error {
+	return DefaultHandlers.HandleService(prefix, svc)
+}
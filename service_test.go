@@ -0,0 +1,81 @@
+package gotalk
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type testCalcService struct {
+	resets int
+}
+
+func (c *testCalcService) Add(args [2]int) (int, error) { return args[0] + args[1], nil }
+func (c *testCalcService) Reset(s *Sock) error          { c.resets++; return nil }
+func (c *testCalcService) Ping(ctx context.Context) (string, error) {
+	return "pong", ctx.Err()
+}
+func (c *testCalcService) unexported() {}
+
+type testBadService struct{}
+
+func (testBadService) Ok() error          { return nil }
+func (testBadService) String() string     { return "bad" }
+func (testBadService) Two(a, b int) error { return nil }
+
+func TestHandleService(t *testing.T) {
+	h := &Handlers{}
+	svc := &testCalcService{}
+	if err := h.HandleService("calc", svc); err != nil {
+		t.Fatal(err)
+	}
+	assertNotNil(t, h.FindBufferRequestHandler("calc.Add"))
+	assertNotNil(t, h.FindBufferRequestHandler("calc.Reset"))
+	assertNotNil(t, h.FindBufferRequestHandler("calc.Ping"))
+	assertEq(t, true, h.FindBufferRequestHandler("calc.unexported") == nil)
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	var sum int
+	if err := s1.Request("calc.Add", [2]int{1, 2}, &sum); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 3, sum)
+	if _, err := s1.BufferRequest("calc.Reset", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 1, svc.resets)
+	var pong string
+	if err := s1.Request("calc.Ping", nil, &pong); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "pong", pong)
+
+	// unsupported signatures
+	h = &Handlers{}
+	err = h.HandleService("", testBadService{})
+	assertError(t,
+		`method gotalk.testBadService.String: invalid handler signature: last return value must be an error`,
+		err)
+	assertEq(t, true, h.FindBufferRequestHandler("Ok") == nil) // nothing registered
+
+	// skip methods by returning "" from opName
+	err = h.HandleServiceFunc("bad", testBadService{}, func(prefix, method string) string {
+		if method == "Ok" {
+			return prefix + "/" + strings.ToLower(method)
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNotNil(t, h.FindBufferRequestHandler("bad/ok"))
+
+	assertError(t, "no exported methods", h.HandleService("x", struct{}{}))
+	assertError(t, "svc is nil", h.HandleService("x", nil))
+}
@@ -0,0 +1,123 @@
+package gotalk
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// SharedLimits limits the resources used by all sockets which share it, as opposed to Limits
+// which apply to each socket individually. Set Limits.Shared of a Server or WebSocketServer to
+// limit all of its sockets, or share one SharedLimits between several servers to limit the
+// whole process.
+//
+// Requests which exceed the limit receive a retry response, just like requests which exceed
+// Limits.BufferRequests or Limits.StreamRequests. Connections which exceed the limit are
+// closed right away.
+//
+// ConnectionsPerIP counts connections by the address of the other end. For web sockets behind
+// a reverse proxy that is the address of the proxy, unless WebSocketServer.ClientAddr says
+// otherwise.
+type SharedLimits struct {
+	Requests         uint32 // max number of concurrent request handlers (0=no limit)
+	Connections      uint32 // max number of concurrent connections (0=no limit)
+	ConnectionsPerIP uint32 // max number of concurrent connections per remote IP (0=no limit)
+
+	requests uint32 // atomic
+	queued   uint32 // atomic
+
+	mu          sync.Mutex
+	connections uint32
+	perIP       map[string]uint32
+}
+
+// ActiveRequests returns the number of request handlers currently running
+func (l *SharedLimits) ActiveRequests() int {
+	return int(atomic.LoadUint32(&l.requests))
+}
+
+// ActiveConnections returns the number of connections currently open
+func (l *SharedLimits) ActiveConnections() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.connections)
+}
+
+// QueuedRequests returns the number of requests waiting in the queues of all sockets.
+// See Limits.QueuedRequests.
+func (l *SharedLimits) QueuedRequests() int {
+	return int(atomic.LoadUint32(&l.queued))
+}
+
+func (l *SharedLimits) incQueued() {
+	atomic.AddUint32(&l.queued, 1)
+}
+
+func (l *SharedLimits) decQueued() {
+	atomic.AddUint32(&l.queued, ^uint32(0))
+}
+
+func (l *SharedLimits) incRequest() bool {
+	n := atomic.AddUint32(&l.requests, 1)
+	if l.Requests != 0 && n > l.Requests {
+		l.decRequest()
+		return false
+	}
+	return true
+}
+
+func (l *SharedLimits) decRequest() {
+	atomic.AddUint32(&l.requests, ^uint32(0))
+}
+
+// addConn registers a connection from ip. Returns false if a limit has been reached.
+func (l *SharedLimits) addConn(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Connections != 0 && l.connections >= l.Connections {
+		return false
+	}
+	if l.ConnectionsPerIP != 0 {
+		if l.perIP[ip] >= l.ConnectionsPerIP {
+			return false
+		}
+		if l.perIP == nil {
+			l.perIP = make(map[string]uint32)
+		}
+		l.perIP[ip]++
+	}
+	l.connections++
+	return true
+}
+
+// removeConn unregisters a connection added with addConn
+func (l *SharedLimits) removeConn(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.connections--
+	if n, ok := l.perIP[ip]; ok {
+		if n <= 1 {
+			delete(l.perIP, ip)
+		} else {
+			l.perIP[ip] = n - 1
+		}
+	}
+}
+
+// acceptConn registers a new connection from addr (e.g. "1.2.3.4:5678") with the shared
+// limits of limits, if any. Returns false if a limit has been reached. Otherwise the returned
+// function must be called when the connection closes.
+func acceptConn(limits *Limits, addr string) (done func(), ok bool) {
+	if limits == nil || limits.Shared == nil {
+		return func() {}, true
+	}
+	l := limits.Shared
+	ip := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = host
+	}
+	if !l.addConn(ip) {
+		return nil, false
+	}
+	return func() { l.removeConn(ip) }, true
+}
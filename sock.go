@@ -1,11 +1,12 @@
 package gotalk
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"runtime"
 	"sync"
@@ -17,10 +18,13 @@ import (
 var (
 	ErrUnexpectedStreamingRes = errors.New("unexpected streaming response")
 	ErrSockClosed             = errors.New("socket closed")
+	ErrPayloadTooLarge        = errors.New("payload too large") // see Limits.MaxPayloadSize
+	ErrDeadlineExceeded       = errors.New("request deadline exceeded")
 )
 
 type pendingResMap map[string]chan Response
 type pendingReqMap map[string]chan []byte
+type activeReqMap map[string]*activeReq
 
 type Sock struct {
 	// Handlers associated with this socket
@@ -41,9 +45,14 @@ type Sock struct {
 	// ProtocolError* constant.
 	CloseHandler func(s *Sock, code int)
 
-	// Automatically retry requests which can be retried
+	// Deprecated: Has no effect. Requests are always retried; use RetryPolicy to limit retries.
 	AutoRetryRequests bool
 
+	// RetryPolicy controls how BufferRequest retries requests which the responder can't handle
+	// right now. If nil, requests are retried until they succeed, fail or ctx is done, waiting
+	// for as long as the responder asks for between attempts.
+	RetryPolicy *RetryPolicy
+
 	// HeartbeatInterval controls how much time a socket waits between sending its heartbeats.
 	// If this is 0, automatic sending of heartbeats is disabled.
 	// Defaults to 20 seconds when created with NewSock.
@@ -52,12 +61,33 @@ type Sock struct {
 	// If not nil, this function is invoked when a heartbeat is recevied
 	OnHeartbeat func(load int, t time.Time)
 
+	// Codec used to encode and decode values by Request, Notify and handlers registered with
+	// Handlers.Handle. If nil, Handlers.Codec is used, or JSONCodec if that is nil too.
+	Codec Codec
+
+	// AuthToken, if not empty, is sent to the server during the handshake for it to
+	// authenticate the socket with (see Server.Authenticator.)
+	AuthToken string
+
 	// -------------------------------------------------------------------------
 	// Used by connected sockets
 	connmu    sync.RWMutex       // guards writes on conn and conn itself (W)
 	conn      io.ReadWriteCloser // non-nil after successful call to Connect or accept
 	closex    uint32             // atomic switch for closing conn (see Close())
 	closeCode int32              // protocol error (ProtocolErrorXXX = closeCode-1)
+	peerCaps  uint32             // atomic; capabilities of the other end (see capabilities.go)
+	ctx       context.Context    // cancelled when conn is closed
+	ctxCancel context.CancelFunc
+
+	peerCapsKnown    uint32     // atomic; non-zero when peerCaps is known
+	peerCapsMu       sync.Mutex // serializes setPeerCaps and guards peerCodecs
+	peerCodecs       []string   // codecs both ends can decode
+	peerMaxPayload   uint32     // atomic; largest payload the other end accepts (0=no limit)
+	peerStreamWindow uint32     // atomic; flow control window of streams the other end receives
+
+	principal atomic.Value // *Principal (see auth.go)
+
+	noteHeaders sync.Map // headers of notifications being handled (see Sock.noteHeader)
 
 	// Used for sending requests:
 	nextOpID     uint32
@@ -68,8 +98,41 @@ type Sock struct {
 	pendingReq   pendingReqMap
 	pendingReqMu sync.RWMutex
 
+	// Used for flow control of streams (see flow.go):
+	streamWindowSize uint32                            // atomic; Limits.StreamWindow
+	reqQueues        map[string]*streamQueue[[]byte]   // guarded by pendingReqMu
+	resQueues        map[string]*streamQueue[Response] // guarded by pendingResMu
+	credits          map[creditKey]*streamCredit
+	creditsMu        sync.Mutex
+
+	// Used for cancelling requests which are being handled:
+	activeReq   activeReqMap
+	activeReqMu sync.Mutex
+
+	// Used for per-operation limits (see Handlers.SetOpLimits)
+	opLimiters   map[*opLimiter]*sockOpLimiter
+	opLimitersMu sync.Mutex
+
+	// Used for queuing buffer requests (see Limits.QueuedRequests)
+	queue requestQueue
+
 	// Used for graceful shutdown
 	shutdownWg *sync.WaitGroup // non-nil means that the socket has been shut down
+	shutdownMu sync.Mutex      // guards shutdownWg and readEnded
+	readEnded  bool            // Read has returned, so it won't call shutdownWg.Done
+	handlerWg  sync.WaitGroup  // request handlers which are running
+
+	// Used for reconnecting (see ConnectKeepAlive)
+	keepAlive *keepAlive
+
+	id uint64 // atomic; assigned by ID()
+
+	// Functions called when the connection closes, keyed by owner (see setCloseHook)
+	closeHooks   map[interface{}]func(*Sock)
+	closeHooksMu sync.Mutex
+
+	// Notifications broadcast to this socket which are waiting to be sent (see notifyAll)
+	noteQueue noteQueue
 }
 
 func NewSock(h *Handlers) *Sock {
@@ -92,7 +155,11 @@ func Pipe(handlers *Handlers, limits *Limits) (*Sock, *Sock, error) {
 	s2 := NewSock(handlers)
 	s1.Adopt(c1)
 	s2.Adopt(c2)
-	// Note: We deliberately ignore performing a handshake
+	// Note: We deliberately ignore performing a handshake. Both ends support the same features,
+	// except that payload limits are enforced by the receiver only.
+	a := s1.announcement(0, limitsStreamWindow(limits))
+	s1.setPeerCaps(a.agree(a))
+	s2.setPeerCaps(a.agree(a))
 	go s1.Read(limits)
 	go s2.Read(limits)
 	return s1, s2, nil
@@ -121,9 +188,20 @@ func (s *Sock) Adopt(r io.ReadWriteCloser) {
 	// lock to wait for any ongoing writes
 	s.connmu.Lock()
 	s.conn = r
+	if s.ctxCancel != nil {
+		s.ctxCancel() // cancel any requests which were handled on a previous connection
+	}
+	s.ctx, s.ctxCancel = context.WithCancel(context.Background())
 	atomic.StoreInt32(&s.closeCode, 0)
 	atomic.StoreUint32(&s.closex, 0)
+	atomic.StoreUint32(&s.peerCaps, 0)
 	s.connmu.Unlock()
+	atomic.StoreUint32(&s.peerMaxPayload, 0)
+	atomic.StoreUint32(&s.peerStreamWindow, 0)
+	s.peerCapsMu.Lock()
+	atomic.StoreUint32(&s.peerCapsKnown, 0)
+	s.peerCodecs = nil
+	s.peerCapsMu.Unlock()
 }
 
 // ----------------------------------------------------------------------------------------------
@@ -160,7 +238,7 @@ func (s *Sock) ConnectTLS(how, addr string, limits *Limits, config *tls.Config)
 // and begin communication on a background goroutine.
 func (s *Sock) ConnectReader(r io.ReadWriteCloser, limits *Limits) error {
 	s.Adopt(r)
-	if err := s.Handshake(); err != nil {
+	if err := s.handshake(limits); err != nil {
 		return err
 	}
 	go s.Read(limits)
@@ -199,7 +277,12 @@ func (s *Sock) forgetResChan(id string) {
 	if ch := s.pendingRes[id]; ch != nil {
 		delete(s.pendingRes, id)
 	}
+	q := s.resQueues[id]
+	delete(s.resQueues, id)
 	s.pendingResMu.Unlock()
+	if q != nil {
+		q.cancel()
+	}
 }
 
 // ----------------------------------------------------------------------------------------------
@@ -237,14 +320,107 @@ func (s *Sock) deallocReqChan(id string) {
 
 // ----------------------------------------------------------------------------------------------
 
+// activeReq represents a request which is being handled
+type activeReq struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled uint32 // atomic; non-zero when the requestor has cancelled the request
+}
+
+// isCancelled returns true if the requestor has cancelled the request
+func (r *activeReq) isCancelled() bool {
+	return atomic.LoadUint32(&r.cancelled) != 0
+}
+
+// connContext returns the context of the current connection, which is cancelled when the
+// connection closes. s.ctx and s.ctxCancel are replaced by Adopt and must only be accessed
+// with connmu held.
+func (s *Sock) connContext() context.Context {
+	s.connmu.RLock()
+	defer s.connmu.RUnlock()
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// beginActiveReq registers a request which is about to be handled.
+// The request's context is cancelled when the requestor cancels the request, when the socket
+// closes, when timeout passes (unless timeout is 0) or when the deadline of meta passes (unless
+// it's zero.) The request's header is available from the context with RequestHeader.
+func (s *Sock) beginActiveReq(id string, timeout time.Duration, meta msgMeta) *activeReq {
+	parent := s.connContext()
+	if meta.header != nil {
+		parent = context.WithValue(parent, reqHeaderKey, meta.header)
+	}
+	deadline := meta.deadline
+	if timeout > 0 {
+		if d := time.Now().Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	r := &activeReq{}
+	if !deadline.IsZero() {
+		r.ctx, r.cancel = context.WithDeadline(parent, deadline)
+	} else {
+		r.ctx, r.cancel = context.WithCancel(parent)
+	}
+	s.activeReqMu.Lock()
+	if s.activeReq == nil {
+		s.activeReq = make(activeReqMap)
+	}
+	s.activeReq[id] = r
+	s.activeReqMu.Unlock()
+	return r
+}
+
+func (s *Sock) endActiveReq(id string, r *activeReq) {
+	s.activeReqMu.Lock()
+	if s.activeReq[id] == r {
+		delete(s.activeReq, id)
+	}
+	s.activeReqMu.Unlock()
+	r.cancel()
+}
+
+func (s *Sock) cancelActiveReq(id string) {
+	s.activeReqMu.Lock()
+	r := s.activeReq[id]
+	delete(s.activeReq, id)
+	s.activeReqMu.Unlock()
+	if r != nil {
+		atomic.StoreUint32(&r.cancelled, 1)
+		r.cancel()
+	}
+}
+
+// ----------------------------------------------------------------------------------------------
+
 func (s *Sock) writeMsg(t MsgType, id, op string, wait uint32, buf []byte) error {
+	return s.writeMsgPrefixed(nil, t, id, op, wait, buf)
+}
+
+// writeMsgPrefixed writes a message preceded by prefix, which holds messages announcing
+// metadata of the message (see msgMeta), so that nothing is written in between.
+// Each part of prefix is written separately, like messages and their payloads, since some
+// transports (e.g. web sockets) deliver each write as a separate frame.
+func (s *Sock) writeMsgPrefixed(
+	prefix [][]byte, t MsgType, id, op string, wait uint32, buf []byte,
+) error {
 	s.connmu.Lock()
 	var err error
 	if s.conn == nil {
 		err = ErrSockClosed
 	} else {
-		msg := MakeMsg(t, id, op, wait, uint32(len(buf)))
-		if _, err = s.conn.Write(msg); err == nil && len(buf) != 0 {
+		for _, b := range prefix {
+			if _, err = s.conn.Write(b); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = s.conn.Write(MakeMsg(t, id, op, wait, uint32(len(buf))))
+		}
+		if err == nil && len(buf) != 0 {
 			_, err = s.conn.Write(buf)
 		}
 	}
@@ -255,18 +431,79 @@ func (s *Sock) writeMsg(t MsgType, id, op string, wait uint32, buf []byte) error
 // Send a single-buffer request.
 // A response should be received from reschan.
 func (s *Sock) SendRequest(r *Request, reschan chan Response) error {
-	if s.shutdownWg != nil {
-		return ErrSockClosed
+	_, err := s.sendRequest(context.Background(), r, reschan)
+	return err
+}
+
+// sendRequest sends r, with the deadline of ctx if it has one
+func (s *Sock) sendRequest(ctx context.Context, r *Request, reschan chan Response) (string, error) {
+	if s.isShutdown() {
+		return "", ErrSockClosed
+	}
+	header := r.Header
+	if header == nil {
+		header, _ = ctx.Value(outHeaderKey).(Header)
 	}
 	id := s.registerResChan(reschan)
-	err := s.writeMsg(r.MsgType, id, r.Op, 0, r.Data)
+	err := s.writeReqMsg(ctx, r.MsgType, id, r.Op, header, 0, r.Data)
 	if err != nil {
 		s.forgetResChan(id)
 		if closeError := s.checkCloseCode(); closeError != nil {
 			err = closeError
 		}
 	}
-	return err
+	return id, err
+}
+
+// writeReqMsg writes a request message, preceded by the deadline of ctx and header, if the
+// other end supports them, and by resWindow, the window of a stream request's results, if
+// non-zero
+func (s *Sock) writeReqMsg(
+	ctx context.Context, t MsgType, id, op string, header Header, resWindow uint32, buf []byte,
+) error {
+	if !s.peerAccepts(len(buf)) {
+		return ErrPayloadTooLarge
+	}
+	var prefix [][]byte
+	if msg := s.makeDeadlineMsg(ctx, id); msg != nil {
+		prefix = append(prefix, msg)
+	}
+	headerMsg, err := s.makeHeaderMsg(id, header)
+	if err != nil {
+		return err
+	}
+	prefix = append(prefix, headerMsg...)
+	if resWindow > 0 {
+		prefix = append(prefix, MakeMsg(MsgTypeStreamResWindow, id, "", resWindow, 0))
+	}
+	return s.writeMsgPrefixed(prefix, t, id, op, 0, buf)
+}
+
+// cancelRequest stops waiting for a response to request id and tells the responder
+// that it can stop working on the request.
+func (s *Sock) cancelRequest(id string) {
+	s.forgetResChan(id)
+	s.closeCredit(MsgTypeStreamReqWindow, id)
+	if s.peerSupports(capCancel) {
+		s.writeMsg(MsgTypeCancelReq, id, "", 0, nil) // ignore error
+	}
+}
+
+// shouldQueueRequests returns true if requests should wait for the connection to be
+// re-established rather than fail when the connection is lost
+func (s *Sock) shouldQueueRequests() bool {
+	k := s.keepAlive
+	return k != nil && k.PendingRequests == PendingRequestsQueue && !k.isStopped()
+}
+
+// shouldRetryConnErrors returns true if requests which fail because the connection was lost
+// should be sent again once the socket has reconnected
+func (s *Sock) shouldRetryConnErrors() bool {
+	if s.shouldQueueRequests() {
+		return true
+	}
+	k, p := s.keepAlive, s.RetryPolicy
+	return k != nil && p != nil && p.RetryConnErrors && !k.isStopped()
 }
 
 func (s *Sock) checkCloseCode() error {
@@ -278,13 +515,33 @@ func (s *Sock) checkCloseCode() error {
 }
 
 // Send a single-buffer request, wait for and return the response.
-// Automatically retries the request if needed.
+// Automatically retries the request if needed; see Sock.RetryPolicy.
 func (s *Sock) BufferRequest(op string, buf []byte) ([]byte, error) {
+	return s.BufferRequestContext(context.Background(), op, buf)
+}
+
+// BufferRequestContext is like BufferRequest but gives up when ctx is done, in which case
+// ctx.Err() is returned and the responder is told that the request has been cancelled.
+// If ctx has a deadline, the responder is told about it so that it can give up too (if it
+// supports deadlines.)
+func (s *Sock) BufferRequestContext(ctx context.Context, op string, buf []byte) ([]byte, error) {
 	reschan := make(chan Response, 1)
 	req := NewRequest(op, buf)
+	retry := newRetryState(s.RetryPolicy)
 	for {
-		err := s.SendRequest(req, reschan)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		conn := s.Conn()
+		id, err := s.sendRequest(ctx, req, reschan)
 		if err != nil {
+			if s.shouldRetryConnErrors() {
+				if err := retry.awaitConnection(ctx, s.keepAlive, conn, err); err != nil {
+					return nil, err
+				}
+				continue
+			}
 			if closeError := s.checkCloseCode(); closeError != nil {
 				err = closeError
 			}
@@ -292,7 +549,14 @@ func (s *Sock) BufferRequest(op string, buf []byte) ([]byte, error) {
 		}
 
 		// await response
-		res, ok := <-reschan
+		var res Response
+		var ok bool
+		select {
+		case res, ok = <-reschan:
+		case <-ctx.Done():
+			s.cancelRequest(id)
+			return nil, ctx.Err()
+		}
 		if !ok {
 			// channel closed
 			err = ErrSockClosed
@@ -302,6 +566,13 @@ func (s *Sock) BufferRequest(op string, buf []byte) ([]byte, error) {
 			return nil, err
 		}
 
+		if res.connLost && s.shouldRetryConnErrors() {
+			if err := retry.awaitConnection(ctx, s.keepAlive, conn, &res); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		if res.IsError() {
 			if res.Wait > 0 {
 				return nil, protocolError(int32(res.Wait))
@@ -314,8 +585,18 @@ func (s *Sock) BufferRequest(op string, buf []byte) ([]byte, error) {
 		}
 
 		if res.IsRetry() {
-			if res.Wait != 0 {
-				time.Sleep(res.Wait)
+			wait, err := retry.next(res.Wait, &res)
+			if err != nil {
+				return nil, err
+			}
+			if wait != 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				}
 			}
 		} else {
 			return res.Data, nil
@@ -323,17 +604,25 @@ func (s *Sock) BufferRequest(op string, buf []byte) ([]byte, error) {
 	}
 }
 
-// Send a single-value request where the input and output values are JSON-encoded
+// Send a single-value request where the input and output values are encoded with the
+// socket's codec (JSON by default; see Codec)
 func (s *Sock) Request(op string, in interface{}, out interface{}) error {
-	inbuf, err := json.Marshal(in)
+	return s.RequestContext(context.Background(), op, in, out)
+}
+
+// RequestContext is like Request but gives up when ctx is done.
+// See BufferRequestContext for details.
+func (s *Sock) RequestContext(ctx context.Context, op string, in interface{}, out interface{}) error {
+	c := s.codec()
+	inbuf, err := c.Marshal(in)
 	if err != nil {
 		return err
 	}
-	outbuf, err := s.BufferRequest(op, inbuf)
+	outbuf, err := s.BufferRequestContext(ctx, op, inbuf)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(outbuf, out)
+	return c.Unmarshal(outbuf, out)
 }
 
 // Send a multi-buffer streaming request
@@ -345,15 +634,29 @@ func (s *Sock) StreamRequest(op string) (*StreamRequest, chan Response) {
 
 // Send a single-buffer notification
 func (s *Sock) BufferNotify(name string, buf []byte) error {
-	if s.shutdownWg != nil {
+	return s.BufferNotifyHeader(name, nil, buf)
+}
+
+// Send a single-buffer notification with a header. The header is only sent if the other end
+// supports headers. See HandleBufferNotificationHeader.
+func (s *Sock) BufferNotifyHeader(name string, header Header, buf []byte) error {
+	if s.isShutdown() {
 		return ErrSockClosed
 	}
-	return s.writeMsg(MsgTypeNotification, "", name, 0, buf)
+	if !s.peerAccepts(len(buf)) {
+		return ErrPayloadTooLarge
+	}
+	prefix, err := s.makeHeaderMsg(noteHeaderID, header)
+	if err != nil {
+		return err
+	}
+	return s.writeMsgPrefixed(prefix, MsgTypeNotification, "", name, 0, buf)
 }
 
-// Send a single-value request where the value is JSON-encoded
+// Send a single-value notification where the value is encoded with the socket's codec
+// (JSON by default; see Codec)
 func (s *Sock) Notify(name string, v interface{}) error {
-	if buf, err := json.Marshal(v); err != nil {
+	if buf, err := s.codec().Marshal(v); err != nil {
 		return err
 	} else {
 		return s.BufferNotify(name, buf)
@@ -364,8 +667,8 @@ func (s *Sock) Notify(name string, v interface{}) error {
 
 func (s *Sock) readDiscard(readz int) error {
 	if readz != 0 {
-		// todo: is there a better way to read data w/o copying it into a buffer?
-		_, err := readn(s.conn, make([]byte, readz))
+		// Copy through a small buffer so that large payloads are never held in memory
+		_, err := io.CopyN(ioutil.Discard, s.conn, int64(readz))
 		return err
 	}
 	return nil
@@ -385,10 +688,6 @@ func (s *Sock) respondRetry(readz int, id string, wait uint32, msg string) error
 	return s.writeMsg(MsgTypeRetryRes, id, "", wait, []byte(msg))
 }
 
-func (s *Sock) respondOK(id string, b []byte) error {
-	return s.writeMsg(MsgTypeSingleRes, id, "", 0, b)
-}
-
 type readDeadline interface {
 	SetReadDeadline(time.Time) error
 }
@@ -396,55 +695,109 @@ type writeDeadline interface {
 	SetWriteDeadline(time.Time) error
 }
 
-func (s *Sock) readBufferReq(lim *limitsImpl, id, op string, size int) error {
-	if lim.incBufferReq() == false {
-		return s.respondRetry(size, id, lim.waitBufferReq(), "request rate limit")
+func (s *Sock) readBufferReq(lim *limitsImpl, id, op string, size int, meta msgMeta) error {
+	if isExpired(meta.deadline) {
+		return s.respondError(size, id, ErrDeadlineExceeded.Error())
+	}
+
+	// Queue the request behind any requests already waiting, even if a slot is free, since
+	// the slot belongs to the first request in the queue
+	if s.queue.depth() > 0 || lim.incBufferReq() == false {
+		return s.queueBufferReq(lim, id, op, size, meta)
 	}
 
-	handler := s.Handlers.FindBufferRequestHandler(op)
+	handler := s.Handlers.FindBufferRequestContextHandler(op)
 	if handler == nil {
 		err := s.respondError(size, id, "unknown operation \""+op+"\"")
 		lim.decBufferReq()
 		return err
 	}
+	if !s.authorize(op) {
+		err := s.respondError(size, id, ErrAccessDenied.Error())
+		lim.decBufferReq()
+		return err
+	}
+
+	releaseOp, wait, refused := s.acquireOp(op, lim.bufferMinWait, lim.bufferMaxWait)
+	if refused != "" {
+		lim.decBufferReq()
+		return s.respondRetry(size, id, wait, refused)
+	}
 
 	// Read complete payload
 	inbuf := make([]byte, size)
 	if _, err := readn(s.conn, inbuf); err != nil {
+		releaseOp()
 		lim.decBufferReq()
 		return err
 	}
 
+	s.handleBufferReq(lim, id, op, handler, releaseOp, inbuf, meta)
+	return nil
+}
+
+// handleBufferReq calls handler in a new goroutine and sends its response
+func (s *Sock) handleBufferReq(
+	lim *limitsImpl, id, op string, handler BufferReqContextHandler, releaseOp func(), inbuf []byte,
+	meta msgMeta,
+) {
+	if isExpired(meta.deadline) {
+		// expired while waiting in the queue
+		releaseOp()
+		lim.decBufferReq()
+		if err := s.respondError(0, id, ErrDeadlineExceeded.Error()); err != nil {
+			s.logRespondErr(op, err)
+			s.close()
+		}
+		return
+	}
+
+	req := s.beginActiveReq(id, s.Handlers.findTimeout(op), meta)
+	resHeader := Header{}
+	ctx := context.WithValue(req.ctx, resHeaderKey, resHeader)
+
 	// Dispatch handler
+	s.handlerWg.Add(1)
 	go func() {
+		defer s.handlerWg.Done()
+		start := time.Now()
 		defer func() {
 			if r := recover(); r != nil {
 				HandlerErrorLogger(s, "error in request handler: %v (op %q)", r, op)
-				if s.conn != nil {
+				if s.conn != nil && !req.isCancelled() {
 					if err := s.respondError(0, id, fmt.Sprint(r)); err != nil {
 						s.logRespondErr(op, err)
-						s.Close()
+						s.close()
 					}
 				}
 			}
+			s.endActiveReq(id, req)
+			releaseOp()
+			lim.observeBufferReq(time.Since(start))
 			lim.decBufferReq()
 		}()
-		outbuf, err := handler(s, op, inbuf)
+		outbuf, err := handler(ctx, s, op, inbuf)
+		if req.isCancelled() {
+			// request was cancelled by the requestor; no one is waiting for a response
+			return
+		}
+		t := MsgTypeSingleRes
+		if err == nil && !s.peerAccepts(len(outbuf)) {
+			err = ErrPayloadTooLarge
+		}
+		var prefix [][]byte
+		if err == nil {
+			prefix, err = s.makeHeaderMsg(id, resHeader)
+		}
 		if err != nil {
 			HandlerErrorLogger(s, "error in request handler: %v (op %q)", err, op)
-			if err := s.respondError(0, id, err.Error()); err != nil {
-				s.logRespondErr(op, err)
-				s.Close()
-			}
-		} else {
-			if err := s.respondOK(id, outbuf); err != nil {
-				s.logRespondErr(op, err)
-				s.Close()
-			}
+			t, outbuf = MsgTypeErrorRes, []byte(err.Error())
+		}
+		if err := s.writeMsgPrefixed(prefix, t, id, "", 0, outbuf); err != nil {
+			s.logRespondErr(op, err)
+			s.close()
 		}
 	}()
-
-	return nil
 }
 
 func (s *Sock) logRespondErr(op string, err error) {
@@ -456,34 +809,76 @@ func (s *Sock) logRespondErr(op string, err error) {
 type streamWriter struct {
 	s        *Sock
 	id       string
+	req      *activeReq
+	credit   *streamCredit
+	rch      chan []byte // parts of the request
+	header   Header      // sent with the first result (see ResponseHeader)
+	err      error       // non-nil if a write was refused because the request's context is done
 	wroteEOS bool
+	wroteAny bool // true once the first result has been sent
+}
+
+// writeRes sends a result, preceded by the response header if it's the first one.
+// If the header can't be sent, no result is sent either, except for an error result.
+func (w *streamWriter) writeRes(t MsgType, b []byte) error {
+	var prefix [][]byte
+	if !w.wroteAny {
+		var err error
+		if prefix, err = w.s.makeHeaderMsg(w.id, w.header); err != nil && t != MsgTypeErrorRes {
+			w.err = err
+			return err
+		}
+		w.wroteAny = true
+	}
+	return w.s.writeMsgPrefixed(prefix, t, w.id, "", 0, b)
 }
 
 func (w *streamWriter) Write(b []byte) (int, error) {
+	if err := w.req.ctx.Err(); err != nil {
+		w.err = err
+		return 0, err
+	}
 	z := len(b)
-	if z == 0 {
+	if !w.s.peerAccepts(z) {
+		return 0, ErrPayloadTooLarge
+	} else if z == 0 {
 		w.wroteEOS = true
+	} else if err := w.credit.take(w.req.ctx, z); err != nil {
+		w.err = err
+		return 0, err
+	}
+	if err := w.writeRes(MsgTypeStreamRes, b); err != nil {
+		return 0, err
 	}
-	return z, w.s.writeMsg(MsgTypeStreamRes, w.id, "", 0, b)
+	return z, nil
 }
 
 func (w *streamWriter) WriteString(s string) (n int, err error) {
-	z := len(s)
-	if z == 0 {
-		w.wroteEOS = true
-	}
-	return z, w.s.writeMsg(MsgTypeStreamRes, w.id, "", 0, []byte(s))
+	return w.Write([]byte(s))
 }
 
 func (w *streamWriter) Close() error {
 	if !w.wroteEOS {
 		w.wroteEOS = true
-		return w.s.writeMsg(MsgTypeStreamRes, w.id, "", 0, nil)
+		return w.writeRes(MsgTypeStreamRes, nil)
 	}
 	return nil
 }
 
-func (s *Sock) readStreamReq(lim *limitsImpl, id, op string, size int) error {
+// stopRequest discards any further parts of the request and, if the requestor understands
+// window updates, tells it to stop sending them with a window update of 0
+func (w *streamWriter) stopRequest() {
+	w.s.endStreamReq(w.id, w.rch)
+	if w.s.peerSupports(capFlow) {
+		w.s.writeMsg(MsgTypeStreamReqWindow, w.id, "", 0, nil) // ignore error
+	}
+}
+
+func (s *Sock) readStreamReq(lim *limitsImpl, id, op string, size int, meta msgMeta) error {
+	if isExpired(meta.deadline) {
+		return s.respondError(size, id, ErrDeadlineExceeded.Error())
+	}
+
 	if lim.incStreamReq() == false {
 		if lim.streamReqEnabled() {
 			return s.respondRetry(size, id, lim.waitStreamReq(), "request rate limit")
@@ -492,48 +887,134 @@ func (s *Sock) readStreamReq(lim *limitsImpl, id, op string, size int) error {
 		}
 	}
 
-	handler := s.Handlers.FindStreamRequestHandler(op)
+	handler := s.Handlers.FindStreamRequestContextHandler(op)
 	if handler == nil {
 		err := s.respondError(size, id, "unknown operation \""+op+"\"")
 		lim.decStreamReq()
 		return err
 	}
+	if !s.authorize(op) {
+		err := s.respondError(size, id, ErrAccessDenied.Error())
+		lim.decStreamReq()
+		return err
+	}
+
+	releaseOp, wait, refused := s.acquireOp(op, lim.streamMinWait, lim.streamMaxWait)
+	if refused != "" {
+		lim.decStreamReq()
+		return s.respondRetry(size, id, wait, refused)
+	}
 
 	// Read first buff
 	inbuf := make([]byte, size)
 	if _, err := readn(s.conn, inbuf); err != nil {
+		releaseOp()
 		lim.decStreamReq()
 		return err
 	}
 
 	// Create read chan
 	rch := s.allocReqChan(id)
-	rch <- inbuf
+	if lim.streamWindow > 0 && s.peerSupports(capFlow) {
+		// buffer parameters in a queue and tell the requestor how much it may send
+		s.startReqQueue(id, rch, lim.streamWindow).push(inbuf, len(inbuf))
+		if err := s.writeMsg(MsgTypeStreamReqWindow, id, "", lim.streamWindow, nil); err != nil {
+			s.endStreamReq(id, rch)
+			releaseOp()
+			lim.decStreamReq()
+			return err
+		}
+	} else {
+		rch <- inbuf
+	}
+
+	req := s.beginActiveReq(id, s.Handlers.findTimeout(op), meta)
+	credit := s.openCredit(MsgTypeStreamResWindow, id)
+	if meta.window > 0 {
+		credit.add(meta.window)
+	}
 
 	// Dispatch handler
+	s.handlerWg.Add(1)
 	go func() {
-		// TODO: recover?
-		out := &streamWriter{s, id, false}
-		if err := handler(s, op, rch, out); err != nil {
-			s.deallocReqChan(id)
-			if err := s.respondError(0, id, err.Error()); err != nil {
-				s.logRespondErr(op, err)
-				s.Close()
+		defer s.handlerWg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				HandlerErrorLogger(s, "error in stream request handler: %v (op %q)", r, op)
+				if s.conn != nil && !req.isCancelled() {
+					if err := s.respondError(0, id, fmt.Sprint(r)); err != nil {
+						s.logRespondErr(op, err)
+						s.close()
+					}
+				}
+			}
+			s.endStreamReq(id, rch)
+			s.closeCredit(MsgTypeStreamResWindow, id)
+			s.endActiveReq(id, req)
+			releaseOp()
+			lim.decStreamReq()
+		}()
+		out := &streamWriter{s: s, id: id, req: req, credit: credit, rch: rch, header: Header{}}
+		ctx := context.WithValue(req.ctx, resHeaderKey, out.header)
+		err := handler(ctx, s, op, rch, out)
+		if err == nil && out.err == nil && !req.isCancelled() {
+			if err = out.Close(); err != nil && out.err == nil {
+				s.close()
+				return
 			}
 		}
-		if err := out.Close(); err != nil {
-			s.Close()
+		if err == nil {
+			// some of the handler's output may have been dropped, or its header not sent
+			err = out.err
+		}
+		if req.isCancelled() {
+			// request was cancelled by the requestor; no one is waiting for a response
+		} else if err != nil {
+			HandlerErrorLogger(s, "error in stream request handler: %v (op %q)", err, op)
+			if err := out.writeRes(MsgTypeErrorRes, []byte(err.Error())); err != nil {
+				s.logRespondErr(op, err)
+				s.close()
+			}
 		}
-		lim.decStreamReq()
 	}()
 
 	return nil
 }
 
-func (s *Sock) readStreamReqPart(lim *limitsImpl, id string, size int) error {
+// endStreamReq stops delivering parts of request id to rch when its handler has returned.
+// The handler may have returned before reading all parts, so any further parts are discarded.
+func (s *Sock) endStreamReq(id string, rch chan []byte) {
+	if s.getReqChan(id) == rch {
+		s.deallocReqChan(id)
+	}
+	if s.endReqQueue(id) {
+		return
+	}
+	// The read loop may have looked up rch before it was deallocated; make room for that part
+	select {
+	case <-rch:
+	default:
+	}
+}
+
+func (s *Sock) readStreamReqPart(id string, size int) error {
+	if q := s.getReqQueue(id); q != nil {
+		var b []byte = nil
+		if size != 0 {
+			b = make([]byte, size)
+			if _, err := readn(s.conn, b); err != nil {
+				return err
+			}
+		}
+		q.push(b, size)
+		return nil
+	}
+
 	rch := s.getReqChan(id)
 	if rch == nil {
-		return errors.New("illegal message") // There was no "start stream" message
+		// The request was either never started or has been cancelled.
+		// Parts may still be in flight after a cancellation, so just ignore the data.
+		return s.readDiscard(size)
 	}
 
 	var b []byte = nil
@@ -541,8 +1022,7 @@ func (s *Sock) readStreamReqPart(lim *limitsImpl, id string, size int) error {
 	if size != 0 {
 		b = make([]byte, size)
 		if _, err := readn(s.conn, b); err != nil {
-			lim.decStreamReq()
-			return err
+			return err // the handler releases the request's limit when it returns
 		}
 	}
 
@@ -552,7 +1032,7 @@ func (s *Sock) readStreamReqPart(lim *limitsImpl, id string, size int) error {
 
 // -----------------------------------------------------------------------------------------------
 
-func (s *Sock) readResponse(t MsgType, id string, wait, size int) error {
+func (s *Sock) readResponse(t MsgType, id string, wait, size int, header Header) error {
 	// read payload
 	var buf []byte
 	if size != 0 {
@@ -563,8 +1043,25 @@ func (s *Sock) readResponse(t MsgType, id string, wait, size int) error {
 		}
 	}
 
+	res := Response{
+		MsgType: t,
+		Data:    buf,
+		Wait:    time.Duration(wait) * time.Millisecond,
+		Header:  header,
+	}
+	if isLastStreamRes(res) {
+		// the responder is done, so stop sending any request stream
+		s.closeCredit(MsgTypeStreamReqWindow, id)
+	}
+
 	// get response channel and hold the lock until we've sent the response
 	s.pendingResMu.Lock()
+	if q := s.resQueues[id]; q != nil {
+		// flow controlled stream; deliver the response in order with any queued results
+		s.pendingResMu.Unlock()
+		q.push(res, size)
+		return nil
+	}
 	ch := s.pendingRes[id]
 	if ch != nil && t != MsgTypeStreamRes {
 		delete(s.pendingRes, id)
@@ -572,16 +1069,44 @@ func (s *Sock) readResponse(t MsgType, id string, wait, size int) error {
 	s.pendingResMu.Unlock()
 
 	if ch != nil {
-		ch <- Response{t, buf, time.Duration(wait) * time.Millisecond}
+		ch <- res
 	}
 
 	return nil
 }
 
-func (s *Sock) readNotification(name string, size int) error {
+// readCancel is called when the requestor cancels a request we are handling
+func (s *Sock) readCancel(id string, size int) error {
+	if err := s.readDiscard(size); err != nil {
+		return err
+	}
+	if rch := s.getReqChan(id); rch != nil {
+		// end the request stream; the handler sees this as EOS
+		s.deallocReqChan(id)
+		if !s.endReqQueue(id) { // else the queue closes rch
+			close(rch)
+		}
+	}
+	if s.queue.remove(id) {
+		return nil
+	}
+	s.cancelActiveReq(id)
+	return nil
+}
+
+func (s *Sock) readNotification(
+	notes *noteDispatcher, name string, size int, header Header,
+) error {
 	handler := s.Handlers.FindNotificationHandler(name)
+	if header != nil {
+		if fn := s.Handlers.findWrappedNotificationHeaderHandler(name); fn != nil {
+			handler = fn
+		} else {
+			header = nil
+		}
+	}
 
-	if handler == nil {
+	if handler == nil || !s.authorize(name) {
 		// read any payload and ignore notification
 		return s.readDiscard(size)
 	}
@@ -595,22 +1120,58 @@ func (s *Sock) readNotification(name string, size int) error {
 		}
 	}
 
-	handler(s, name, buf)
+	if header != nil {
+		handler, buf = s.withNoteHeader(handler, header, buf)
+	}
+	notes.dispatch(handler, name, buf)
 	return nil
 }
 
+// callNotificationHandler calls handler, recovering from and logging any panic so that a
+// misbehaving handler doesn't bring down the read loop
+func (s *Sock) callNotificationHandler(handler BufferNoteHandler, name string, buf []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			HandlerErrorLogger(s, "error in notification handler: %v (name %q)", r, name)
+		}
+	}()
+	handler(s, name, buf)
+}
+
 // Before reading any messages over a socket, handshake must happen. This function will block
 // until the handshake either succeeds or fails.
+//
+// Besides the protocol version, the handshake tells the other end which protocol features
+// this end supports. See Sock.Capabilities.
 func (s *Sock) Handshake() error {
+	return s.handshake(&Limits{}) // limits are unknown
+}
+
+// handshake performs the handshake, announcing the payload size limit and stream window of
+// limits, which the socket is going to read with. nil means DefaultLimits.
+func (s *Sock) handshake(limits *Limits) error {
+	if limits == nil {
+		limits = DefaultLimits
+	}
 	// Write, read and compare version
 	if _, err := WriteVersion(s.conn); err != nil {
-		s.Close()
+		s.close()
 		return err
 	}
 	if _, err := ReadVersion(s.conn); err != nil {
-		s.Close()
+		s.close()
 		return err
 	}
+	if err := s.sendCapabilities(limits.MaxPayloadSize, limits.StreamWindow); err != nil {
+		s.close()
+		return err
+	}
+	if s.AuthToken != "" {
+		if err := s.sendAuthToken(); err != nil {
+			s.close()
+			return err
+		}
+	}
 	return nil
 }
 
@@ -619,6 +1180,9 @@ var (
 	ErrUnsupported = errors.New("unsupported protocol")
 	ErrInvalidMsg  = errors.New("invalid protocol message")
 	ErrTimeout     = errors.New("timeout")
+
+	// ErrUnauthorized is returned when the server rejects the credentials of the socket
+	ErrUnauthorized = errors.New("unauthorized")
 )
 
 func protocolError(code int32) error {
@@ -631,6 +1195,8 @@ func protocolError(code int32) error {
 		return ErrInvalidMsg
 	case ProtocolErrorTimeout:
 		return ErrTimeout
+	case ProtocolErrorUnauthorized:
+		return ErrUnauthorized
 	default:
 		return errors.New("unknown error")
 	}
@@ -663,6 +1229,30 @@ func (s *Sock) sendHeartbeats(stopChan chan bool) {
 	}
 }
 
+// beginRead is called when Read starts and returns the shutdown wait group, if any
+func (s *Sock) beginRead() *sync.WaitGroup {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	s.readEnded = false
+	return s.shutdownWg
+}
+
+// endRead is called when Read is about to return and returns the shutdown wait group, if any.
+// If Shutdown is called after this, it takes care of calling Done on its wait group.
+func (s *Sock) endRead() *sync.WaitGroup {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	s.readEnded = true
+	return s.shutdownWg
+}
+
+// isShutdown returns true if Shutdown has been called
+func (s *Sock) isShutdown() bool {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	return s.shutdownWg != nil
+}
+
 func (s *Sock) SendHeartbeat(load float32, buf []byte) error {
 	msg := MakeHeartbeatMsg(uint16(load*float32(HeartbeatMsgMaxLoad)), buf)
 	s.connmu.Lock()
@@ -687,11 +1277,19 @@ func (s *Sock) setProcolError(protocolErrorCode int32) {
 // socket. Does not return until the socket is closed.
 // If HeartbeatInterval > 0 this method also sends automatic heartbeats.
 func (s *Sock) Read(limits *Limits) error {
-	if s.shutdownWg != nil {
+	if wg := s.beginRead(); wg != nil {
+		// shut down before we started reading
+		s.close()
+		wg.Done()
 		return ErrSockClosed
 	}
 
 	lim := makeLimitsImpl(limits)
+	atomic.StoreUint32(&s.streamWindowSize, lim.streamWindow)
+	if lim.queueSize > 0 {
+		s.queue.init(s, &lim)
+		lim.queue = &s.queue
+	}
 
 	s.connmu.RLock()
 	conn := s.conn
@@ -716,7 +1314,10 @@ func (s *Sock) Read(limits *Limits) error {
 		go s.sendHeartbeats(heartbeatStopChan)
 	}
 
+	notes := newNoteDispatcher(s, &lim)
+
 	var err error
+	var meta pendingMeta // metadata of the next message
 	readbuf := make([]byte, 128)
 
 readloop:
@@ -735,14 +1336,15 @@ readloop:
 		// s.CloseError(ProtocolErrorInvalidMsg)
 		// return ErrInvalidMsg
 
-		// Set read timeout
-		if hasReadDeadline {
+		// Set read timeout, unless Shutdown has set a deadline
+		if hasReadDeadline && !s.isShutdown() {
 			if rd, ok := conn.(readDeadline); ok {
 				if err = rd.SetReadDeadline(time.Now().Add(lim.readTimeout)); err != nil {
 					// If we failed to set read timeout, close socket immediately and report error.
 					// The alternative, to ignore that read deadline could not be set, would be dangerous
 					// in case that the user relies on timeouts for resource management and security.
-					s.Close()
+					s.close()
+					notes.stop()
 					return err
 				}
 			}
@@ -752,24 +1354,80 @@ readloop:
 		t, id, name, wait, size, err1 := ReadMsg(conn, readbuf)
 		err = err1
 
+		if err == nil && lim.isPayloadTooLarge(t, size) && !isAnnouncement(t, name, size) {
+			if (t != MsgTypeSingleReq && t != MsgTypeStreamReq) || size > maxDiscardSize {
+				s.closeError(ProtocolErrorInvalidMsg)
+				err = ErrInvalidMsg
+				break readloop
+			}
+			// Tell the requestor, without reading the payload into memory
+			if err = s.respondError(int(size), id, ErrPayloadTooLarge.Error()); err == nil {
+				meta = pendingMeta{}
+				continue
+			}
+		}
+
+		if err == nil && !s.peerCapsAreKnown() &&
+			(t != MsgTypeNotification || name != capabilitiesNoteName) {
+			// the other end didn't announce any capabilities before sending this message
+			s.setPeerCaps(announcement{})
+		}
+
 		if err == nil {
 			// fmt.Printf("Read: msg: t=%c  id=%q  name=%q  size=%v\n", byte(t), id, name, size)
 
 			switch t {
 			case MsgTypeSingleReq:
-				err = s.readBufferReq(&lim, id, name, int(size))
+				err = s.readBufferReq(&lim, id, name, int(size), meta.of(id))
 
 			case MsgTypeStreamReq:
-				err = s.readStreamReq(&lim, id, name, int(size))
+				err = s.readStreamReq(&lim, id, name, int(size), meta.of(id))
+
+			case MsgTypeReqDeadline:
+				if err = s.readDiscard(int(size)); err == nil {
+					meta.set(id).deadline = time.Now().Add(time.Duration(wait) * time.Millisecond)
+				}
+
+			case MsgTypeHeader:
+				var header Header
+				if header, err = s.readHeader(int(size)); err == nil {
+					meta.set(id).header = header
+				} else if err == ErrInvalidMsg {
+					s.closeError(ProtocolErrorInvalidMsg)
+					break readloop
+				}
 
 			case MsgTypeStreamReqPart:
-				err = s.readStreamReqPart(&lim, id, int(size))
+				err = s.readStreamReqPart(id, int(size))
 
 			case MsgTypeSingleRes, MsgTypeStreamRes, MsgTypeErrorRes, MsgTypeRetryRes:
-				err = s.readResponse(t, id, int(wait), int(size))
+				err = s.readResponse(t, id, int(wait), int(size), meta.of(id).header)
 
 			case MsgTypeNotification:
-				err = s.readNotification(name, int(size))
+				if name == capabilitiesNoteName {
+					// never passed on to handlers, even if it's not a valid announcement
+					if err = s.readCapabilities(int(size)); err == ErrInvalidMsg {
+						s.closeError(ProtocolErrorInvalidMsg)
+						break readloop
+					}
+				} else if name == authNoteName {
+					// we don't use authentication, or have already authenticated the client
+					err = s.readDiscard(int(size))
+				} else {
+					err = s.readNotification(notes, name, int(size), meta.of(noteHeaderID).header)
+				}
+
+			case MsgTypeCancelReq:
+				err = s.readCancel(id, int(size))
+
+			case MsgTypeStreamReqWindow:
+				err = s.readWindowUpdate(t, id, wait, int(size))
+
+			case MsgTypeStreamResWindow:
+				// the first window of a stream's results precedes the request
+				if err = s.readWindowUpdate(t, id, wait, int(size)); err == nil {
+					meta.set(id).window = wait
+				}
 
 			case MsgTypeHeartbeat:
 				if s.OnHeartbeat != nil {
@@ -779,40 +1437,53 @@ readloop:
 			case MsgTypeProtocolError:
 				code := int32(size)
 				s.setProcolError(code)
-				if s.shutdownWg == nil {
-					s.Close()
+				if !s.isShutdown() {
+					s.close()
 				}
 				err = protocolError(code)
 				break readloop
 
 			default:
-				s.CloseError(ProtocolErrorInvalidMsg)
+				s.closeError(ProtocolErrorInvalidMsg)
 				err = ErrInvalidMsg
 				break readloop
 			}
+
+			if t != MsgTypeReqDeadline && t != MsgTypeHeader && t != MsgTypeStreamResWindow {
+				// metadata only applies to the message which immediately follows it
+				meta = pendingMeta{}
+			}
 		}
 
 		if err != nil {
 			if err == io.EOF {
-				s.Close()
+				s.close()
 			} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				if s.shutdownWg == nil {
-					s.CloseError(ProtocolErrorTimeout)
+				if !s.isShutdown() {
+					s.closeError(ProtocolErrorTimeout)
 				}
 			} else {
 				// Broken connection (e.g. pipe error, connection reset by peer, etc.)
 				// Don't log this as it happens often and "naturally."
 				err = io.EOF
-				s.Close()
+				s.close()
 			}
 			break
 		}
 
 	} // readloop
 
-	if s.shutdownWg != nil {
-		s.Close()
-		s.shutdownWg.Done()
+	notes.stop()
+
+	if wg := s.endRead(); wg != nil {
+		// Let handlers which are still running finish and send their responses.
+		// The write deadline set by Shutdown only applies to writes which were ongoing at the time.
+		if wd, ok := conn.(writeDeadline); ok {
+			wd.SetWriteDeadline(time.Time{})
+		}
+		s.handlerWg.Wait()
+		s.close()
+		wg.Done()
 	}
 
 	if heartbeatStopChan != nil {
@@ -835,6 +1506,11 @@ func (s *Sock) Addr() string {
 
 // Close this socket because of a protocol error (ProtocolErrorXXX)
 func (s *Sock) CloseError(protocolErrorCode int32) error {
+	s.stopKeepAlive()
+	return s.closeError(protocolErrorCode)
+}
+
+func (s *Sock) closeError(protocolErrorCode int32) error {
 	if protocolErrorCode < 0 {
 		panic("negative protocolErrorCode")
 	}
@@ -843,7 +1519,7 @@ func (s *Sock) CloseError(protocolErrorCode int32) error {
 	msg := MakeMsg(MsgTypeProtocolError, "", "", 0, uint32(protocolErrorCode))
 	s.conn.Write(msg) // ignore error
 	s.connmu.Unlock()
-	err := s.Close()
+	err := s.close()
 	return err
 }
 
@@ -854,8 +1530,16 @@ func (s *Sock) IsClosed() bool {
 }
 
 // Close this socket.
+// If the socket was connected with ConnectKeepAlive, it will no longer reconnect.
 // It is safe for multiple goroutines to call this concurrently.
 func (s *Sock) Close() error {
+	s.stopKeepAlive()
+	return s.close()
+}
+
+// close closes the current connection. Unlike Close, a socket with keep-alive enabled
+// reconnects after the connection has been closed with close.
+func (s *Sock) close() error {
 	if atomic.AddUint32(&s.closex, 1) != 1 {
 		// another goroutine won the race or already closed
 		return nil
@@ -867,6 +1551,11 @@ func (s *Sock) Close() error {
 	// close the underlying connection
 	err := s.conn.Close()
 
+	// cancel the contexts of any requests being handled (ctxCancel is guarded by connmu)
+	if s.ctxCancel != nil {
+		s.ctxCancel()
+	}
+
 	// check for close error
 	closeCode := atomic.LoadInt32(&s.closeCode)
 	if closeCode > 0 {
@@ -889,53 +1578,103 @@ func (s *Sock) Close() error {
 		}
 		select {
 		case ch <- Response{
-			MsgType: MsgTypeErrorRes,
-			Data:    errmsg,
-			Wait:    waitarg,
+			MsgType:  MsgTypeErrorRes,
+			Data:     errmsg,
+			Wait:     waitarg,
+			connLost: true,
 		}:
 		default:
 		}
 	}
 
 	s.pendingRes = nil
+	for _, q := range s.resQueues {
+		q.cancel()
+	}
+	s.resQueues = nil
 
 	s.connmu.Unlock()
 	s.pendingResMu.Unlock()
 
+	s.closeStreams()
+
 	// call CloseHandler
 	if s.CloseHandler != nil {
 		s.CloseHandler(s, int(closeCode))
 	}
 
+	// call internal close hooks
+	s.closeHooksMu.Lock()
+	hooks := make([]func(*Sock), 0, len(s.closeHooks))
+	for _, f := range s.closeHooks {
+		hooks = append(hooks, f)
+	}
+	s.closeHooksMu.Unlock()
+	for _, f := range hooks {
+		f(s)
+	}
+
 	return err
 }
 
+// setCloseHook registers f to be called when the connection closes, replacing any function
+// previously registered by owner. If f is nil, owner's function is removed.
+func (s *Sock) setCloseHook(owner interface{}, f func(*Sock)) {
+	s.closeHooksMu.Lock()
+	defer s.closeHooksMu.Unlock()
+	if f == nil {
+		delete(s.closeHooks, owner)
+		return
+	}
+	if s.closeHooks == nil {
+		s.closeHooks = make(map[interface{}]func(*Sock))
+	}
+	s.closeHooks[owner] = f
+}
+
 // Shut down this socket, giving it timeout time to complete any ongoing work.
 //
 // timeout should be a short duration as its used for I/O read and write timeout; any work in
 // handlers does not account to the timeout (and is unlimited.) timeout is ignored if the
 // underlying Conn() does not implement SetReadDeadline or SetWriteDeadline.
 //
-// This method returns immediately. Once all work is complete, calls s.Close() and wg.Done().
+// This method returns immediately. Once all work is complete, including request handlers
+// which are running, calls s.Close() and wg.Done().
 //
 // This method should not be used with web socket connections. Instead, call Close() from
 // your http.Server.RegisterOnShutdown handler.
 //
 func (s *Sock) Shutdown(wg *sync.WaitGroup, timeout time.Duration) error {
+	s.shutdownMu.Lock()
 	if s.shutdownWg != nil {
+		s.shutdownMu.Unlock()
 		return ErrSockClosed
 	}
 	s.shutdownWg = wg
+	readEnded := s.readEnded
+	s.shutdownMu.Unlock()
+	s.stopKeepAlive()
+
+	if readEnded {
+		// Read has already returned and won't finish the shutdown
+		go func() {
+			s.handlerWg.Wait()
+			s.close()
+			wg.Done()
+		}()
+		return nil
+	}
 
 	// give the connection a very short time to complete reads & writes
 	deadline := time.Now().Add(timeout)
+	conn := s.Conn()
 
 	var err error
-	if rd, ok := s.conn.(readDeadline); ok {
+	if rd, ok := conn.(readDeadline); ok {
 		// give a Read call a short amount of time to complete
 		err = rd.SetReadDeadline(deadline)
 	}
-	if wd, ok := s.conn.(writeDeadline); ok {
+	if wd, ok := conn.(writeDeadline); ok {
 		// give a Read call a short amount of time to complete
 		err = wd.SetWriteDeadline(deadline)
 	}
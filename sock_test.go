@@ -0,0 +1,391 @@
+package gotalk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor calls cond until it returns true or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBufferRequestContext(t *testing.T) {
+	h := &Handlers{}
+	release := make(chan struct{})
+	defer close(release)
+	h.HandleBufferRequest("slow", func(s *Sock, op string, b []byte) ([]byte, error) {
+		<-release
+		return b, nil
+	})
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// a request which completes in time
+	buf, err := s1.BufferRequestContext(context.Background(), "echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytes(t, []byte("hello"), buf)
+
+	// a request which times out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s1.BufferRequestContext(ctx, "slow", nil)
+	assertEq(t, context.DeadlineExceeded, err)
+
+	// requestor should no longer track the request
+	s1.pendingResMu.RLock()
+	assertEq(t, 0, len(s1.pendingRes))
+	s1.pendingResMu.RUnlock()
+
+	// responder should have received the cancel message
+	waitFor(t, "cancel message", func() bool {
+		s2.activeReqMu.Lock()
+		defer s2.activeReqMu.Unlock()
+		return len(s2.activeReq) == 0
+	})
+
+	// an already-cancelled context should not send anything
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = s1.BufferRequestContext(ctx, "echo", nil)
+	assertEq(t, context.Canceled, err)
+}
+
+func TestHandlerContext(t *testing.T) {
+	h := &Handlers{}
+	started := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	h.HandleBufferRequestContext("wait", func(
+		ctx context.Context, s *Sock, op string, b []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	h.SetTimeout("wait", time.Hour)
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	// cancelled by the requestor
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = s1.BufferRequestContext(ctx, "wait", nil)
+	assertEq(t, context.Canceled, err)
+	<-started
+	assertEq(t, context.Canceled, <-done)
+
+	// cancelled by the operation's timeout
+	h.SetTimeout("wait", 10*time.Millisecond)
+	_, err = s1.BufferRequest("wait", nil)
+	assertError(t, "deadline exceeded", err)
+	<-started
+	assertEq(t, context.DeadlineExceeded, <-done)
+
+	// cancelled when the socket closes
+	h.SetTimeout("wait", 0)
+	go s1.BufferRequest("wait", nil)
+	<-started
+	s2.Close()
+	assertEq(t, context.Canceled, <-done)
+}
+
+func TestCancelRequestConnected(t *testing.T) {
+	// cancel messages are sent over connections made with Connect and Accept
+	h := &Handlers{}
+	started := make(chan struct{}, 1)
+	done := make(chan error, 1)
+	h.HandleBufferRequestContext("wait", func(
+		ctx context.Context, s *Sock, op string, b []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	c, _ := connectTestServer(t, h, NoLimits)
+	assertEq(t, true, c.Capabilities().Has("cancel"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := c.BufferRequestContext(ctx, "wait", nil)
+	assertEq(t, context.Canceled, err)
+	select {
+	case err := <-done:
+		assertEq(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
+
+func TestCloseWhileAdopting(t *testing.T) {
+	// Adopt, as done when a keep-alive socket reconnects, replaces the connection's context
+	// while Close may be cancelling it. Run with -race.
+	s := NewSock(&Handlers{})
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s.Adopt(c1)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			s.Adopt(c1)
+		}()
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			s.endActiveReq("0001", s.beginActiveReq("0001", 0, msgMeta{}))
+		}()
+	}
+	wg.Wait()
+	s.Close()
+}
+
+func TestConnectKeepAlive(t *testing.T) {
+	h := &Handlers{}
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+
+	server, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Handlers = h
+	accepted := make(chan *Sock, 4)
+	server.AcceptHandler = func(s *Sock) { accepted <- s }
+	go server.Accept()
+
+	states := make(chan ConnState, 16)
+	s := NewSock(h)
+	err = s.ConnectKeepAlive(&KeepAlive{
+		Dial: func() (io.ReadWriteCloser, error) {
+			return net.Dial("tcp", server.Addr())
+		},
+		MinDelay:        time.Millisecond,
+		PendingRequests: PendingRequestsQueue,
+		Limits:          &Limits{MaxPayloadSize: 1024},
+		OnStateChange: func(s *Sock, state ConnState, err error) {
+			states <- state
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, ConnStateConnecting, <-states)
+	assertEq(t, ConnStateConnected, <-states)
+
+	buf, err := s.BufferRequest("echo", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytes(t, []byte("1"), buf)
+
+	// The server drops the connection. The request should be queued until the socket
+	// has reconnected.
+	(<-accepted).Close()
+	buf, err = s.BufferRequest("echo", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytes(t, []byte("2"), buf)
+	assertEq(t, ConnStateDisconnected, <-states)
+	assertEq(t, ConnStateConnecting, <-states)
+	assertEq(t, ConnStateConnected, <-states)
+	server2 := <-accepted
+
+	// the limits are announced to the server on every connection
+	waitFor(t, "capabilities", server2.peerCapsAreKnown)
+	assertEq(t, uint32(1024), server2.Capabilities().MaxPayloadSize)
+
+	// Closing the socket stops it from reconnecting
+	s.Close()
+	assertEq(t, ConnStateClosed, <-states)
+	_, err = s.BufferRequest("echo", nil)
+	if err == nil {
+		t.Fatal("expected request on closed socket to fail")
+	}
+	waitFor(t, "server to notice", server2.IsClosed)
+	select {
+	case <-accepted:
+		t.Fatal("unexpected reconnect")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+	h := &Handlers{}
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+	h.HandleBufferNotification("note", func(s *Sock, name string, b []byte) {})
+
+	s1, s2, err := Pipe(h, &Limits{BufferRequests: Unlimited, MaxPayloadSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// an oversized request receives an error response
+	_, err = s1.BufferRequest("echo", make([]byte, 33))
+	assertError(t, "payload too large", err)
+
+	// the connection is still usable
+	buf, err := s1.BufferRequest("echo", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 32, len(buf))
+
+	// any other oversized message causes the connection to be closed.
+	// Writing the payload may fail as the peer closes the connection after reading the header.
+	s1.BufferNotify("note", make([]byte, 33))
+	waitFor(t, "connection to be closed", s1.IsClosed)
+	assertEq(t, ErrInvalidMsg, s1.checkCloseCode())
+
+	// so does a request with a payload too large to be worth discarding
+	defer func(z uint32) { maxDiscardSize = z }(maxDiscardSize)
+	maxDiscardSize = 64
+	s1, s2, err = Pipe(h, &Limits{BufferRequests: Unlimited, MaxPayloadSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	_, err = s1.BufferRequest("echo", make([]byte, 64))
+	assertError(t, "payload too large", err)
+	s1.BufferRequest("echo", make([]byte, 65))
+	waitFor(t, "connection to be closed", s1.IsClosed)
+	assertEq(t, ErrInvalidMsg, s1.checkCloseCode())
+}
+
+func TestMaxPayloadSizeMeta(t *testing.T) {
+	// the metadata of a rejected request doesn't apply to the next request with the same ID
+	h := &Handlers{}
+	h.HandleBufferRequestContext("echo", func(
+		ctx context.Context, s *Sock, op string, b []byte) ([]byte, error) {
+		return []byte(RequestHeader(ctx)["user"]), nil
+	})
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	s := NewSock(h)
+	s.Adopt(c2)
+	go s.Read(&Limits{BufferRequests: Unlimited, MaxPayloadSize: 32})
+
+	go func() {
+		block, _ := encodeHeader(Header{"user": "robin"})
+		c1.Write(append(MakeMsg(MsgTypeHeader, "0001", "", 0, uint32(len(block))), block...))
+		c1.Write(append(MakeMsg(MsgTypeSingleReq, "0001", "echo", 0, 33), make([]byte, 33)...))
+		c1.Write(MakeMsg(MsgTypeSingleReq, "0001", "echo", 0, 0))
+	}()
+
+	readbuf := make([]byte, 128)
+	for _, expect := range []MsgType{MsgTypeErrorRes, MsgTypeSingleRes} {
+		mt, id, _, _, size, err := ReadMsg(c1, readbuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := make([]byte, size)
+		if _, err := readn(c1, payload); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, expect, mt)
+		assertEq(t, "0001", id)
+		if mt == MsgTypeSingleRes {
+			assertEq(t, "", string(payload))
+		}
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	logged := make(chan string, 10)
+	defer func(f LoggerFunc) { HandlerErrorLogger = f }(HandlerErrorLogger)
+	HandlerErrorLogger = func(s *Sock, format string, args ...interface{}) {
+		logged <- fmt.Sprintf(format, args...)
+	}
+
+	h := &Handlers{}
+	h.HandleStreamRequest("stream", func(s *Sock, op string, rch chan []byte, out io.WriteCloser) error {
+		panic("stream boom")
+	})
+	h.HandleBufferNotification("note", func(s *Sock, name string, b []byte) {
+		panic("note boom")
+	})
+	h.HandleBufferRequest("echo", func(s *Sock, op string, b []byte) ([]byte, error) {
+		return b, nil
+	})
+
+	// allow one stream request at a time, so that a leaked limit slot would be noticed
+	s1, s2, err := Pipe(h, &Limits{BufferRequests: Unlimited, StreamRequests: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	for i := 0; i < 2; i++ {
+		var r Response
+		for {
+			req, res := s1.StreamRequest("stream")
+			if err := req.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			// the slot of the previous request may not have been released quite yet
+			if r = <-res; !r.IsRetry() {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		assertEq(t, MsgTypeErrorRes, r.MsgType)
+		assertEq(t, "stream boom", string(r.Data))
+		assertEq(t, `error in stream request handler: stream boom (op "stream")`, <-logged)
+	}
+
+	if err := s1.BufferNotify("note", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, `error in notification handler: note boom (name "note")`, <-logged)
+	b, err := s1.BufferRequest("echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "hello", string(b))
+}
@@ -0,0 +1,368 @@
+package gotalk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrStreamClosed is returned when using a stream which has been closed or has ended
+var ErrStreamClosed = errors.New("stream closed")
+
+// StreamHandler handles a streaming request, reading the request's parameters from in and
+// writing results to out. Values can be read with in.Next and written with out.Encode, or the
+// streams can be used as an io.Reader and io.Writer. The result stream is ended when the
+// handler returns; if it returns an error, the error is sent to the requestor instead.
+// See BufferReqContextHandler for details on the context.
+type StreamHandler func(
+	ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error
+
+// StreamReader reads the parts of a stream, either the results of a streaming request
+// (see Sock.OpenStream) or the parameters of a streaming request (see Handlers.HandleStream.)
+// StreamReader implements io.ReadCloser. It must not be used concurrently.
+type StreamReader struct {
+	codec Codec
+	next  func() ([]byte, error) // returns the next part, or an error at the end of the stream
+	stop  func()                 // called when the reader is closed before the end of the stream
+	buf   []byte                 // data of the current part which has not yet been read
+	err   error                  // non-nil when the stream has ended
+
+	header Header // header of the results of a streaming request
+}
+
+// Header returns the header which the responder sent with the results of a streaming request
+// (see ResponseHeader), once the first result has been read. Returns nil if there's none.
+func (r *StreamReader) Header() Header {
+	return r.header
+}
+
+// ReadPart returns the next part of the stream, as sent by one write on the other end.
+// io.EOF is returned at the end of the stream.
+func (r *StreamReader) ReadPart() ([]byte, error) {
+	if len(r.buf) != 0 {
+		b := r.buf
+		r.buf = nil
+		return b, nil
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	b, err := r.next()
+	if err != nil {
+		r.err = err
+		return nil, err
+	}
+	return b, nil
+}
+
+// Read implements io.Reader
+func (r *StreamReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		b, err := r.ReadPart()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = b
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Next reads the next part of the stream and decodes it into v with the socket's codec
+// (JSON by default; see Codec.) io.EOF is returned at the end of the stream.
+func (r *StreamReader) Next(v interface{}) error {
+	b, err := r.ReadPart()
+	if err != nil {
+		return err
+	}
+	return r.codec.Unmarshal(b, v)
+}
+
+// Close stops reading the stream. If the stream has not ended, the other end is told to
+// stop sending: closing the results of a streaming request cancels the request and closing
+// the parameters of a streaming request makes the requestor's writes fail with
+// ErrStreamClosed. Peers which don't support this keep sending parameters, which are
+// discarded. Reading from a closed stream returns ErrStreamClosed.
+func (r *StreamReader) Close() error {
+	r.buf = nil
+	if r.err == nil {
+		r.err = ErrStreamClosed
+		r.stop()
+	}
+	return nil
+}
+
+// StreamWriter writes the parts of a stream, either the parameters of a streaming request
+// (see Sock.OpenStream) or the results of a streaming request (see Handlers.HandleStream.)
+// StreamWriter implements io.WriteCloser. It must not be used concurrently.
+type StreamWriter struct {
+	codec  Codec
+	write  func([]byte) error
+	end    func() error
+	closed bool
+}
+
+// Write sends p as one part of the stream. Empty writes are ignored since an empty part
+// marks the end of a stream.
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Encode sends v, encoded with the socket's codec (JSON by default; see Codec), as one part
+// of the stream.
+func (w *StreamWriter) Encode(v interface{}) error {
+	b, err := w.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Close ends the stream. Calling Close more than once has no effect.
+func (w *StreamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.end()
+}
+
+// OpenStream starts a streaming request for op. Parameters are sent by writing to the
+// returned StreamWriter, which must be closed to tell the responder that there are no more
+// parameters. Results are read from the returned StreamReader, which should be read until it
+// returns an error, or be closed.
+//
+// The request is not sent until the first write to, or closing of, the StreamWriter.
+// Once the results have ended, the StreamReader has been closed or the responder has stopped
+// reading parameters, writes fail with ErrStreamClosed. When ctx is done, reading returns
+// ctx.Err() and the responder is told that the request has been cancelled. For example:
+//
+//   w, r := s.OpenStream(ctx, "sum")
+//   for i := 0; i < 10; i++ {
+//     w.Encode(i)
+//   }
+//   w.Close()
+//   var sum int
+//   for r.Next(&sum) == nil {
+//     log.Printf("sum: %d", sum)
+//   }
+//
+func (s *Sock) OpenStream(ctx context.Context, op string) (*StreamWriter, *StreamReader) {
+	// Buffered so that cancelRequest can drain a response which the read loop is in the
+	// middle of delivering. See StreamReader.Close.
+	reschan := make(chan Response, 1)
+	req := &StreamRequest{sock: s, op: op}
+
+	sockctx := s.connContext()
+
+	// mu guards id, which is set when the request is sent, and ended, which is set when
+	// results have ended or the reader was closed
+	var mu sync.Mutex
+	var id string
+	var ended bool
+	c := s.codec()
+
+	// send sends b as the next part of the request, sending the request first if needed.
+	// The response channel is registered only then, so that a stream which is never written
+	// to or closed doesn't leave it behind.
+	send := func(b []byte) error {
+		mu.Lock()
+		if ended {
+			mu.Unlock()
+			return ErrStreamClosed
+		}
+		if id != "" {
+			mu.Unlock()
+			return req.write(ctx, b)
+		}
+		defer mu.Unlock()
+		id = s.registerResChan(reschan)
+		req.id = id
+		return req.write(ctx, b)
+	}
+
+	w := &StreamWriter{
+		codec: c,
+		write: func(b []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return send(b)
+		},
+		end: func() error {
+			mu.Lock()
+			isEnded, started := ended, id != ""
+			mu.Unlock()
+			if isEnded {
+				return nil
+			}
+			if !started {
+				if err := send(nil); err != nil {
+					return err
+				}
+			}
+			return req.End()
+		},
+	}
+
+	single := false // true after a single (non-streaming) result was received
+	end := func(err error) ([]byte, error) {
+		mu.Lock()
+		ended = true
+		s.forgetResChan(id)
+		mu.Unlock()
+		return nil, err
+	}
+	var r *StreamReader
+	result := func(res Response) ([]byte, error) {
+		if res.Header != nil {
+			r.header = res.Header
+		}
+		switch {
+		case res.IsError():
+			if res.Wait > 0 {
+				return end(protocolError(int32(res.Wait)))
+			}
+			return end(&res)
+		case res.IsRetry():
+			// can't resend the parts of a stream which have already been sent
+			return end(&res)
+		case res.IsStreaming():
+			if len(res.Data) == 0 {
+				return end(io.EOF)
+			}
+			return res.Data, nil
+		}
+		single = true
+		mu.Lock()
+		ended = true
+		mu.Unlock()
+		return res.Data, nil
+	}
+
+	r = &StreamReader{
+		codec: c,
+		next: func() ([]byte, error) {
+			if single {
+				return end(io.EOF)
+			}
+			select {
+			case res := <-reschan:
+				return result(res)
+			case <-ctx.Done():
+				mu.Lock()
+				ended = true
+				if id != "" {
+					s.cancelRequest(id)
+				}
+				mu.Unlock()
+				return nil, ctx.Err()
+			case <-sockctx.Done():
+				select {
+				case res := <-reschan:
+					return result(res)
+				default:
+				}
+				err := ErrSockClosed
+				if closeError := s.checkCloseCode(); closeError != nil {
+					err = closeError
+				}
+				return end(err)
+			}
+		},
+		stop: func() {
+			mu.Lock()
+			wasEnded := ended
+			ended = true
+			if id == "" {
+				// the request was never sent
+			} else if !wasEnded {
+				s.cancelRequest(id)
+			} else {
+				s.forgetResChan(id)
+			}
+			mu.Unlock()
+			// The read loop may have looked up reschan before we forgot it. Make room for
+			// that response so that the read loop doesn't block.
+			select {
+			case <-reschan:
+			default:
+			}
+		},
+	}
+
+	return w, r
+}
+
+// Handle streaming requests for op with a StreamHandler.
+// If `op` is empty, handle all requests which doesn't have a specific handler registered.
+func (h *Handlers) HandleStream(op string, fn StreamHandler) {
+	h.HandleStreamRequestContext(op, func(
+		ctx context.Context, s *Sock, op string, rch chan []byte, out io.WriteCloser) error {
+		c := s.codec()
+		in := &StreamReader{
+			codec: c,
+			next: func() ([]byte, error) {
+				for {
+					select {
+					case b := <-rch:
+						if b == nil {
+							return nil, io.EOF
+						}
+						if len(b) != 0 { // the first part may be empty
+							return b, nil
+						}
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+				}
+			},
+			stop: func() {
+				if sw, ok := out.(*streamWriter); ok {
+					sw.stopRequest()
+					return
+				}
+				// discard any further parameters until the request ends
+				go func() {
+					for {
+						select {
+						case b := <-rch:
+							if b == nil {
+								return
+							}
+						case <-ctx.Done():
+							return
+						}
+					}
+				}()
+			},
+		}
+		w := &StreamWriter{
+			codec: c,
+			write: func(b []byte) error {
+				_, err := out.Write(b)
+				return err
+			},
+			end: out.Close,
+		}
+		return fn(ctx, s, op, in, w)
+	})
+}
+
+// Handle streaming requests for op with a StreamHandler.
+// If `op` is empty, handle all requests which doesn't have a specific handler registered.
+func HandleStream(op string, fn StreamHandler) {
+	DefaultHandlers.HandleStream(op, fn)
+}
@@ -0,0 +1,196 @@
+package gotalk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	h := &Handlers{}
+	h.HandleStream("sum", func(
+		ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error {
+		sum := 0
+		for {
+			var n int
+			if err := in.Next(&n); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if n < 0 {
+				return errors.New("negative number")
+			}
+			sum += n
+			if err := out.Encode(sum); err != nil {
+				return err
+			}
+		}
+	})
+	h.HandleStream("echo", func(
+		ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error {
+		_, err := io.Copy(out, in)
+		return err
+	})
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	ctx := context.Background()
+
+	// values
+	w, r := s1.OpenStream(ctx, "sum")
+	for i := 1; i <= 3; i++ {
+		if err := w.Encode(i); err != nil {
+			t.Fatal(err)
+		}
+		var sum int
+		if err := r.Next(&sum); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, i*(i+1)/2, sum)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var sum int
+	assertEq(t, io.EOF, r.Next(&sum))
+	assertEq(t, ErrStreamClosed, w.Encode(1))
+
+	// handler error
+	w, r = s1.OpenStream(ctx, "sum")
+	w.Encode(-1)
+	assertError(t, "negative number", r.Next(&sum))
+
+	// io.Reader and io.Writer
+	w, r = s1.OpenStream(ctx, "echo")
+	go func() {
+		w.Write([]byte("hello "))
+		w.Write([]byte("world"))
+		w.Close()
+	}()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, "hello world", string(b))
+
+	// closing the writer without writing sends an empty request
+	w, r = s1.OpenStream(ctx, "echo")
+	w.Close()
+	assertEq(t, io.EOF, r.Next(&sum))
+}
+
+func TestStreamClose(t *testing.T) {
+	h := &Handlers{}
+	handlerErr := make(chan error, 1)
+	h.HandleStream("count", func(
+		ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error {
+		in.Close() // we don't care about parameters
+		for i := 0; ; i++ {
+			if err := out.Encode(i); err != nil {
+				handlerErr <- err
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	// closing the reader cancels the request, which the handler notices
+	w, r := s1.OpenStream(context.Background(), "count")
+	w.Encode("a")
+	for i := 0; i < 3; i++ {
+		var n int
+		if err := r.Next(&n); err != nil {
+			t.Fatal(err)
+		}
+		assertEq(t, i, n)
+	}
+	r.Close()
+	var n int
+	assertEq(t, ErrStreamClosed, r.Next(&n))
+	assertEq(t, ErrStreamClosed, w.Encode("b"))
+	select {
+	case err := <-handlerErr:
+		assertEq(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+
+	// parameters sent after the handler closed its input are discarded
+	ctx, cancel := context.WithCancel(context.Background())
+	w, r = s1.OpenStream(ctx, "count")
+	for i := 0; i < 10; i++ {
+		w.Encode(i)
+	}
+	if err := r.Next(&n); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for r.Next(&n) == nil {
+	}
+	assertEq(t, context.Canceled, r.Next(&n))
+	<-handlerErr
+}
+
+func TestStreamStopRequest(t *testing.T) {
+	h := &Handlers{}
+	stopped := make(chan struct{})
+	h.HandleStream("first", func(
+		ctx context.Context, s *Sock, op string, in *StreamReader, out *StreamWriter) error {
+		var n int
+		if err := in.Next(&n); err != nil {
+			return err
+		}
+		in.Close() // tells the requestor to stop sending
+		<-stopped
+		return out.Encode(n)
+	})
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	w, r := s1.OpenStream(context.Background(), "first")
+	for i := 0; ; i++ {
+		if err := w.Encode(i); err != nil {
+			assertEq(t, ErrStreamClosed, err)
+			break
+		}
+		if i == 5000 {
+			t.Fatal("requestor was not told to stop sending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stopped)
+	var n int
+	if err := r.Next(&n); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 0, n)
+	assertEq(t, io.EOF, r.Next(&n))
+	assertEq(t, nil, w.Close())
+
+	// a stream which is never written to doesn't register a request
+	s1.OpenStream(context.Background(), "first")
+	s1.pendingResMu.Lock()
+	pending := len(s1.pendingRes)
+	s1.pendingResMu.Unlock()
+	assertEq(t, 0, pending)
+}
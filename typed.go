@@ -0,0 +1,68 @@
+package gotalk
+
+import (
+	"context"
+)
+
+// TypedReqHandler is a type-safe request handler. See HandleTyped.
+type TypedReqHandler[In, Out any] func(ctx context.Context, s *Sock, in In) (Out, error)
+
+// HandleTyped registers a type-safe handler for op with h.
+// It is the type-safe counterpart of Handlers.Handle: the parameters of a request are decoded
+// into a value of type In and the result of fn is encoded with the codec of the socket
+// (see Codec). Unlike Handle, signature mistakes are caught at compile time and fn is called
+// directly rather than via reflection. For example:
+//
+//   gotalk.HandleTyped(h, "add", func(ctx context.Context, s *gotalk.Sock, args [2]int) (int, error) {
+//     return args[0] + args[1], nil
+//   })
+//
+// If h is nil, DefaultHandlers is used. If op is empty, handle all requests which doesn't have
+// a specific handler registered.
+func HandleTyped[In, Out any](h *Handlers, op string, fn TypedReqHandler[In, Out]) {
+	if h == nil {
+		h = DefaultHandlers
+	}
+	h.HandleBufferRequestContext(op, wrapTypedReqHandler(fn))
+}
+
+func wrapTypedReqHandler[In, Out any](fn TypedReqHandler[In, Out]) BufferReqContextHandler {
+	return func(ctx context.Context, s *Sock, _ string, inbuf []byte) ([]byte, error) {
+		c := s.codec()
+		var in In
+		if err := c.Unmarshal(inbuf, &in); err != nil {
+			return nil, errUnexpectedParamType
+		}
+		out, err := fn(ctx, s, in)
+		if err != nil {
+			return nil, err
+		}
+		return c.Marshal(out)
+	}
+}
+
+// Call sends a request for op with in and returns the result decoded into a value of type Out.
+// It is the type-safe counterpart of Sock.Request. For example:
+//
+//   sum, err := gotalk.Call[[2]int, int](s, "add", [2]int{1, 2})
+//
+func Call[In, Out any](s *Sock, op string, in In) (Out, error) {
+	return CallContext[In, Out](context.Background(), s, op, in)
+}
+
+// CallContext is like Call but gives up when ctx is done.
+// See Sock.BufferRequestContext for details.
+func CallContext[In, Out any](ctx context.Context, s *Sock, op string, in In) (Out, error) {
+	var out Out
+	c := s.codec()
+	inbuf, err := c.Marshal(in)
+	if err != nil {
+		return out, err
+	}
+	outbuf, err := s.BufferRequestContext(ctx, op, inbuf)
+	if err != nil {
+		return out, err
+	}
+	err = c.Unmarshal(outbuf, &out)
+	return out, err
+}
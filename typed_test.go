@@ -0,0 +1,74 @@
+package gotalk
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestHandleTyped(t *testing.T) {
+	type point struct{ X, Y int }
+
+	h := &Handlers{}
+	HandleTyped(h, "add", func(ctx context.Context, s *Sock, args [2]int) (int, error) {
+		return args[0] + args[1], nil
+	})
+	HandleTyped(h, "mirror", func(ctx context.Context, s *Sock, p point) (point, error) {
+		if p.X < 0 {
+			return p, errors.New("negative")
+		}
+		return point{p.Y, p.X}, nil
+	})
+
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	sum, err := Call[[2]int, int](s1, "add", [2]int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 3, sum)
+
+	p, err := Call[point, point](s1, "mirror", point{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, point{2, 1}, p)
+
+	// handler error
+	_, err = Call[point, point](s1, "mirror", point{-1, 2})
+	assertError(t, "negative", err)
+
+	// mismatched parameter type
+	_, err = Call[string, int](s1, "add", "hello")
+	assertError(t, errUnexpectedParamType.Error(), err)
+
+	// typed handlers can be called with Request and vice versa
+	var sum2 int
+	if err := s1.Request("add", []int{3, 4}, &sum2); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 7, sum2)
+}
+
+func TestHandleTypedCodec(t *testing.T) {
+	h := &Handlers{Codec: GobCodec}
+	HandleTyped(h, "len", func(ctx context.Context, s *Sock, in string) (int, error) {
+		return len(in), nil
+	})
+	s1, s2, err := Pipe(h, NoLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	defer s2.Close()
+	n, err := CallContext[string, int](context.Background(), s1, "len", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, 5, n)
+}
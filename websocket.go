@@ -87,12 +87,27 @@ type WebSocketServer struct {
 	// Not used directly by WebSocketServer but assigned to every new socket that is connected.
 	OnHeartbeat func(load int, t time.Time)
 
+	// Authenticator, if not nil, authenticates new sockets right after the handshake, before
+	// OnConnect is called. Sockets it rejects are closed. The credentials include the HTTP
+	// request which opened the web socket, e.g. for cookie-based authentication.
+	Authenticator Authenticator
+
+	// ClientAddr, if not nil, returns the address of the client which opened a web socket with
+	// the HTTP request r. It is used to enforce SharedLimits.ConnectionsPerIP. By default the
+	// remote address of r is used, which is the address of the proxy when the server is behind
+	// a reverse proxy. Such servers may return the client address which the proxy forwards,
+	// e.g. in a X-Forwarded-For header.
+	ClientAddr func(r *http.Request) string
+
 	// Underlying websocket server (will become a function in gotalk 2)
 	Server *websocket.Server
 
 	// DEPRECATED use OnConnect instead
 	OnAccept SockHandler
 
+	// Connected sockets. See Sockets, Broadcast, etc.
+	sockRegistry
+
 	// storage for underlying web socket server.
 	// Server is a pointer to this for legacy reasons.
 	// Gotalk <=1.1.5 allocated websocket.Server separately on the heap and assigned it to Server.
@@ -149,6 +164,17 @@ func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // onAccept is called for new web socket connections
 func (server *WebSocketServer) onAccept(ws *WebSocketConnection) {
+	addr := ws.Request().RemoteAddr
+	if server.ClientAddr != nil {
+		addr = server.ClientAddr(ws.Request())
+	}
+	done, ok := acceptConn(server.Limits, addr)
+	if !ok {
+		ws.Close()
+		return
+	}
+	defer done()
+
 	// Set the frame payload type of the web socket
 	ws.PayloadType = websocket.BinaryFrame
 
@@ -171,10 +197,26 @@ func (server *WebSocketServer) onAccept(ws *WebSocketConnection) {
 	sock.Adopt(ws)
 
 	// perform protocol handshake
-	if err := sock.Handshake(); err != nil {
+	if err := sock.handshake(server.Limits); err != nil {
+		sock.Close()
+		return
+	}
+
+	// authenticate the socket
+	if server.Authenticator != nil {
+		req := ws.Request()
+		creds := &Credentials{Request: req, TLS: req.TLS}
+		if sock.authenticate(server.Authenticator, creds) != nil {
+			return
+		}
+	}
+
+	// Keep track of the socket while it's connected
+	if !server.addSock(&sock.Sock) {
 		sock.Close()
 		return
 	}
+	defer server.removeSock(&sock.Sock)
 
 	// Call optional OnConnect handler
 	if server.OnConnect != nil {